@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+)
+
+// apiError is returned by API handlers to respond with status instead of
+// 500.
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+// handleAPIError is the JSON counterpart of handleError. Errors are written
+// as {"error": {"status": 404, "message": "..."}}.
+func handleAPIError(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := h(w, r)
+		if err == nil {
+			return
+		}
+		body := apiError{Status: http.StatusInternalServerError, Message: err.Error()}
+		if aerr, ok := errors.Cause(err).(*apiError); ok {
+			body = *aerr
+		} else {
+			log.Printf("%+v", err)
+		}
+		writeJSON(w, body.Status, struct {
+			Error apiError `json:"error"`
+		}{body})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("%+v", errors.WithStack(err))
+	}
+}
+
+// apiHandler serves the JSON API:
+//
+//	GET /api/v1/comments
+//	GET /api/v1/users/{user}/comments
+//	GET /api/v1/orgs/{org}/comments
+//	GET /api/v1/repos/{owner}/{repo}/comments
+//	GET /api/v1/trending
+//	GET /api/v1/status
+//
+// The comments endpoints take the query parameters of the pages.
+func apiHandler(broker *broker, cache *cache, scheduler *scheduler, store *store) http.HandlerFunc {
+	return handleAPIError(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			return &apiError{Status: http.StatusMethodNotAllowed, Message: http.StatusText(http.StatusMethodNotAllowed)}
+		}
+
+		split := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+		filter, err := parseFilterQuery(r.URL.Query())
+		if err != nil {
+			return &apiError{Status: http.StatusBadRequest, Message: err.Error()}
+		}
+		switch {
+		case len(split) == 1 && split[0] == "status":
+			writeJSON(w, http.StatusOK, getStatus(broker, cache))
+			return nil
+		case len(split) == 1 && split[0] == "trending":
+			window := r.URL.Query().Get("window")
+			if _, ok := windows[window]; !ok {
+				window = "7d"
+			}
+			comments, err := store.getTrending(r.Context(), time.Now().Add(-windows[window]))
+			if err != nil {
+				return err
+			}
+			writeJSON(w, http.StatusOK, newAPICommentPage(&commentPage{Comments: comments}))
+			return nil
+		case len(split) == 1 && split[0] == "comments":
+		case len(split) == 3 && split[0] == "users" && split[2] == "comments":
+			filter.User = split[1]
+		case len(split) == 3 && split[0] == "orgs" && split[2] == "comments":
+			filter.Org = split[1]
+		case len(split) == 4 && split[0] == "repos" && split[3] == "comments":
+			filter.Repo = strings.Join([]string{split[1], split[2]}, "/")
+		default:
+			return &apiError{Status: http.StatusNotFound, Message: http.StatusText(http.StatusNotFound)}
+		}
+
+		if err := publishFilter(r.Context(), broker, scheduler, filter); err != nil {
+			return err
+		}
+		page, err := store.getComments(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, newAPICommentPage(page))
+		return nil
+	})
+}
+
+type apiCommentPage struct {
+	Comments []apiComment `json:"comments"`
+	// cursors for the after and before query parameters
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+type apiComment struct {
+	Kind      string            `json:"kind"`
+	ID        int64             `json:"id"`
+	HTMLURL   string            `json:"html_url"`
+	User      string            `json:"user"`
+	Repo      string            `json:"repo"`
+	Body      string            `json:"body"`
+	CreatedAt time.Time         `json:"created_at"`
+	Reactions *github.Reactions `json:"reactions"`
+	Gained    int               `json:"gained,omitempty"` // on trending comments
+
+	Title    string `json:"title,omitempty"`
+	Path     string `json:"path,omitempty"`
+	DiffHunk string `json:"diff_hunk,omitempty"`
+	CommitID string `json:"commit_id,omitempty"`
+	Team     string `json:"team,omitempty"`
+	// HTML, with the matches of the search in <mark>
+	Snippet string `json:"snippet,omitempty"`
+}
+
+func newAPICommentPage(page *commentPage) apiCommentPage {
+	p := apiCommentPage{Comments: make([]apiComment, len(page.Comments))}
+	for i, c := range page.Comments {
+		p.Comments[i] = apiComment{
+			Kind:      c.Kind,
+			ID:        c.Comment.GetID(),
+			HTMLURL:   c.Comment.GetHTMLURL(),
+			User:      c.Comment.GetUser().GetLogin(),
+			Repo:      c.Repo,
+			Body:      c.Comment.GetBody(),
+			CreatedAt: c.Comment.GetCreatedAt(),
+			Reactions: c.Comment.Reactions,
+			Gained:    c.Gained,
+			Title:     c.Title,
+			Path:      c.Path,
+			DiffHunk:  c.DiffHunk,
+			CommitID:  c.CommitID,
+			Team:      c.Team,
+			Snippet:   string(c.Snippet),
+		}
+	}
+	if page.Next != nil {
+		p.Next = page.Next.String()
+	}
+	if page.Prev != nil {
+		p.Prev = page.Prev.String()
+	}
+	return p
+}
@@ -2,22 +2,34 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"html/template"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
-	"text/template"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/google/go-github/github"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
-	blackfriday "gopkg.in/russross/blackfriday.v2"
 )
 
 type app struct {
-	receiver *receiver
-	fetcher  *fetcher
+	receiver  *receiver
+	fetcher   *fetcher
+	scheduler *scheduler
+	transport *cachingTransport
+
+	// how long stored responses are kept once they are not used anymore
+	httpCacheTTL time.Duration
+
+	concurrency       int
+	visibilityTimeout time.Duration
 
 	port string
 	mux  *http.ServeMux
@@ -26,35 +38,56 @@ type app struct {
 func newApp() *app {
 	app := new(app)
 
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://:6379"
+	app.concurrency, _ = strconv.Atoi(os.Getenv("WORKER_CONCURRENCY"))
+	if app.concurrency <= 0 {
+		app.concurrency = 4
 	}
-	opts, err := redis.ParseURL(redisURL)
-	if err != nil {
-		panic(err)
-	}
-	poolsize, _ := strconv.Atoi(os.Getenv("REDIS_POOL_SIZE"))
-	opts.PoolSize = poolsize
-	redis := redis.NewClient(opts)
-	if err := redis.Ping().Err(); err != nil {
+
+	db := mustConnectDB()
+	if err := checkSchema(context.Background(), db); err != nil {
 		panic(err)
 	}
-	cache := newCache(redis)
-	broker := newBroker(redis)
+	store := newStore(db)
 
-	databaseURL := os.Getenv("DATABASE_URL")
-	if databaseURL == "" {
-		databaseURL = "host=/tmp"
+	// BROKER_BACKEND is one of redis (the default), postgres or memory. Redis
+	// is then only used by the cache if REDIS_URL is set.
+	var (
+		backend backend
+		kv      kv
+	)
+	redisURL := os.Getenv("REDIS_URL")
+	switch backendName := os.Getenv("BROKER_BACKEND"); backendName {
+	case "", "redis":
+		redis := mustConnectRedis(redisURL, app.concurrency)
+		backend = newRedisBackend(redis)
+		kv = newRedisKV(redis)
+	case "postgres":
+		backend = newPostgresBackend(db)
+	case "memory":
+		backend = newMemoryBackend()
+	default:
+		panic(fmt.Sprintf("unknown BROKER_BACKEND %q", backendName))
+	}
+	if kv == nil && redisURL != "" {
+		kv = newRedisKV(mustConnectRedis(redisURL, app.concurrency))
+	} else if kv == nil {
+		kv = newMemoryKV()
 	}
-	store := newStore(sqlx.MustConnect("postgres", databaseURL))
+	cache := newCache(kv)
+	broker := newBroker(backend)
 
+	app.transport = newCachingTransport(store, http.DefaultTransport)
+	app.httpCacheTTL, _ = time.ParseDuration(os.Getenv("HTTP_CACHE_TTL"))
+	if app.httpCacheTTL <= 0 {
+		app.httpCacheTTL = 7 * 24 * time.Hour
+	}
 	var githubClient *github.Client
+	httpClient := &http.Client{Transport: app.transport}
 	githubToken := os.Getenv("GITHUB_TOKEN")
 	if githubToken != "" {
 		githubClient = github.NewClient(
 			oauth2.NewClient(
-				context.Background(),
+				context.WithValue(context.Background(), oauth2.HTTPClient, httpClient),
 				oauth2.StaticTokenSource(
 					&oauth2.Token{
 						AccessToken: githubToken,
@@ -63,26 +96,112 @@ func newApp() *app {
 			),
 		)
 	} else {
-		githubClient = github.NewClient(nil)
+		githubClient = github.NewClient(httpClient)
 	}
 
-	app.receiver = newReceiver(redis)
-	app.fetcher = newFetcher(broker, cache, store, githubClient)
+	cooldowns := map[string]time.Duration{
+		"org":    time.Hour,
+		"repo":   10 * time.Minute,
+		"user":   10 * time.Minute,
+		"issue":  time.Minute,
+		"commit": 10 * time.Minute,
+		"teams":  time.Hour,
+	}
+	// e.g. FETCH_COOLDOWNS=repo=1h,user=30m
+	cooldownSettings, err := parseDurations("FETCH_COOLDOWNS")
+	if err != nil {
+		panic(err)
+	}
+	for typ, d := range cooldownSettings {
+		cooldowns[typ] = d
+	}
+	app.receiver = newReceiver(backend, cache, cooldowns)
+	app.visibilityTimeout, _ = time.ParseDuration(os.Getenv("VISIBILITY_TIMEOUT"))
+	if app.visibilityTimeout <= 0 {
+		app.visibilityTimeout = 5 * time.Minute
+	}
 
-	template := template.Must(template.New("").Funcs(template.FuncMap{
-		"markdown": func(in string) string {
-			return string(blackfriday.Run(
-				[]byte(in),
-				blackfriday.WithExtensions(blackfriday.CommonExtensions|blackfriday.HardLineBreak),
-			))
-		},
-	}).ParseGlob("templates/*.html"))
+	// SCHEDULE_INTERVAL is how often visited users, orgs and repos are
+	// fetched again, spending at most SCHEDULE_RATE_SHARE of the remaining
+	// rate limits. SCHEDULE_INTERVALS sets it by type, e.g.
+	// SCHEDULE_INTERVALS=repo=6h,org=72h
+	scheduleInterval, _ := time.ParseDuration(os.Getenv("SCHEDULE_INTERVAL"))
+	if scheduleInterval <= 0 {
+		scheduleInterval = 24 * time.Hour
+	}
+	scheduleIntervals, err := parseDurations("SCHEDULE_INTERVALS")
+	if err != nil {
+		panic(err)
+	}
+	scheduleRateShare, _ := strconv.ParseFloat(os.Getenv("SCHEDULE_RATE_SHARE"), 64)
+	if scheduleRateShare <= 0 || scheduleRateShare > 1 {
+		scheduleRateShare = 0.5
+	}
+	app.scheduler = newScheduler(broker, cache, store, scheduleInterval, scheduleIntervals, scheduleRateShare)
+	app.fetcher = newFetcher(broker, cache, store, app.scheduler, githubClient)
+
+	template := parseTemplates()
 
 	app.port = os.Getenv("PORT")
 	if app.port == "" {
 		app.port = "8080"
 	}
-	app.mux = newMux(broker, cache, store, template)
+	app.mux = newMux(broker, cache, app.scheduler, store, template)
 
 	return app
 }
+
+// parseTemplates parses the templates of the pages.
+func parseTemplates() *template.Template {
+	return template.Must(template.New("").Funcs(template.FuncMap{
+		// comments are untrusted, their HTML is sanitized
+		"markdown": func(in string) template.HTML { return template.HTML(renderMarkdown(in)) },
+	}).ParseGlob("templates/*.html"))
+}
+
+// parseDurations parses the environment variable name, a comma separated list
+// of type=duration settings. Settings without = are ignored.
+func parseDurations(name string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, setting := range strings.Split(os.Getenv(name), ",") {
+		split := strings.SplitN(setting, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		d, err := time.ParseDuration(split[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse %s", name)
+		}
+		durations[split[0]] = d
+	}
+	return durations, nil
+}
+
+func mustConnectDB() *sqlx.DB {
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		databaseURL = "host=/tmp"
+	}
+	return sqlx.MustConnect("postgres", databaseURL)
+}
+
+func mustConnectRedis(redisURL string, concurrency int) *redis.Client {
+	if redisURL == "" {
+		redisURL = "redis://:6379"
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		panic(err)
+	}
+	poolsize, _ := strconv.Atoi(os.Getenv("REDIS_POOL_SIZE"))
+	if poolsize > 0 && poolsize <= concurrency {
+		// each worker holds a connection while blocked in BRPopLPush
+		log.Printf("REDIS_POOL_SIZE=%d leaves no connection for %d workers to publish", poolsize, concurrency)
+	}
+	opts.PoolSize = poolsize
+	client := redis.NewClient(opts)
+	if err := client.Ping().Err(); err != nil {
+		panic(err)
+	}
+	return client
+}
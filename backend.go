@@ -0,0 +1,51 @@
+package main
+
+import "time"
+
+// backend stores the payloads of queues. A payload is either pending in one of
+// the lanes of its queue, processing, scheduled or dead. Backends also keep
+// the keys of pending and recently completed payloads, for deduplication.
+//
+// backend is implemented by redisBackend, postgresBackend and memoryBackend.
+type backend interface {
+	// Push appends b to lane, unless a payload with the same key is pending
+	// or in cooldown. A payload with the same key that is pending in a lane
+	// of lower priority is replaced by b in lane instead, so that publishing
+	// at a higher priority is never skipped. It reports whether b was pushed.
+	Push(queue, lane, key string, b []byte) (bool, error)
+	// Pop moves the first payload of lanes, in order, to processing and
+	// claims it. It waits up to wait for a payload, and returns a nil payload
+	// if there is none.
+	Pop(queue string, lanes []string, wait time.Duration) ([]byte, string, error)
+	// Claim records that b is still processing.
+	Claim(queue string, b []byte) error
+	// Ack removes b from processing, and keeps key in cooldown for cooldown.
+	Ack(queue string, b []byte, key string, cooldown time.Duration) error
+	// Retry replaces b in processing with retried, scheduled at at.
+	Retry(queue string, b, retried []byte, at time.Time) error
+	// Bury replaces b in processing with dead in the dead payloads, and
+	// forgets key.
+	Bury(queue string, b, dead []byte, key string) error
+	// Unbury replaces b in the dead payloads with requeued in lane, and marks
+	// key pending. It reports whether b was still dead.
+	Unbury(queue string, b, requeued []byte, lane, key string) (bool, error)
+	// Dead returns the n most recent dead payloads, or all of them if n < 0.
+	Dead(queue string, n int) ([][]byte, error)
+	// Promote moves the scheduled payloads that are due at now to their lane.
+	Promote(queue string, now time.Time) error
+	// RequeueAbandoned moves the payloads of processing that were last
+	// claimed before deadline back to their lane. It also forgets the expired
+	// keys, unless they expire on their own.
+	RequeueAbandoned(queue string, deadline time.Time) error
+	// Counts returns the number of payloads in each list of queue.
+	Counts(queue string) (map[string]int64, error)
+}
+
+// dedupTTL bounds how long a payload can be considered pending, in case its
+// completion is never recorded.
+const dedupTTL = 24 * time.Hour
+
+// lists returns the names of the lists of queue, as returned by Counts.
+func lists(queue string) []string {
+	return append(lanes(queue), queue+"-processing", queue+"-scheduled", queue+"-dead")
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// memoryBackend implements backend in process memory, for single process
+// installs. Payloads are lost when the process exits.
+type memoryBackend struct {
+	mu     sync.Mutex
+	queues map[string]*memoryQueue
+	pushed chan struct{} // notifies Pop of new payloads
+}
+
+type memoryQueue struct {
+	lanes      map[string][][]byte // oldest first
+	processing []memoryEntry       // at is the claim time
+	scheduled  []memoryEntry       // at is the due time
+	dead       [][]byte            // most recent first
+	keys       map[string]time.Time
+}
+
+type memoryEntry struct {
+	b  []byte
+	at time.Time
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		queues: make(map[string]*memoryQueue),
+		pushed: make(chan struct{}, 1),
+	}
+}
+
+// queue returns the lists of queue. m.mu must be held.
+func (m *memoryBackend) queue(queue string) *memoryQueue {
+	q, ok := m.queues[queue]
+	if !ok {
+		q = &memoryQueue{lanes: make(map[string][][]byte), keys: make(map[string]time.Time)}
+		m.queues[queue] = q
+	}
+	return q
+}
+
+func (m *memoryBackend) notify() {
+	select {
+	case m.pushed <- struct{}{}:
+	default:
+	}
+}
+
+// take removes the first entry holding b from entries.
+func take(entries []memoryEntry, b []byte) ([]memoryEntry, bool) {
+	for i := range entries {
+		if bytes.Equal(entries[i].b, b) {
+			return append(entries[:i], entries[i+1:]...), true
+		}
+	}
+	return entries, false
+}
+
+func (m *memoryBackend) Push(queue, lane, key string, b []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	if expires, ok := q.keys[key]; ok && time.Now().Before(expires) {
+		return m.raise(q, queue, lane, key, b)
+	}
+	q.keys[key] = time.Now().Add(dedupTTL)
+	q.lanes[lane] = append(q.lanes[lane], b)
+	m.notify()
+	return true, nil
+}
+
+// raise replaces the payload with key pending in a lane of lower priority
+// than lane with b in lane. m.mu must be held.
+func (m *memoryBackend) raise(q *memoryQueue, queue, lane, key string, b []byte) (bool, error) {
+	for _, lower := range lowerLanes(queue, lane) {
+		for i, pending := range q.lanes[lower] {
+			var p payload
+			if err := json.Unmarshal(pending, &p); err != nil {
+				return false, errors.WithStack(err)
+			}
+			if p.Key != key {
+				continue
+			}
+			q.lanes[lower] = append(q.lanes[lower][:i], q.lanes[lower][i+1:]...)
+			q.keys[key] = time.Now().Add(dedupTTL)
+			q.lanes[lane] = append(q.lanes[lane], b)
+			m.notify()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryBackend) Pop(queue string, lanes []string, wait time.Duration) ([]byte, string, error) {
+	if b, lane := m.pop(queue, lanes); b != nil {
+		return b, lane, nil
+	}
+	select {
+	case <-m.pushed:
+	case <-time.After(wait):
+	}
+	b, lane := m.pop(queue, lanes)
+	return b, lane, nil
+}
+
+func (m *memoryBackend) pop(queue string, lanes []string) ([]byte, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	for _, lane := range lanes {
+		if len(q.lanes[lane]) == 0 {
+			continue
+		}
+		b := q.lanes[lane][0]
+		q.lanes[lane] = q.lanes[lane][1:]
+		q.processing = append(q.processing, memoryEntry{b: b, at: time.Now()})
+		return b, lane
+	}
+	return nil, ""
+}
+
+func (m *memoryBackend) Claim(queue string, b []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	for i := range q.processing {
+		if bytes.Equal(q.processing[i].b, b) {
+			q.processing[i].at = time.Now()
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) Ack(queue string, b []byte, key string, cooldown time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	q.processing, _ = take(q.processing, b)
+	if cooldown > 0 {
+		q.keys[key] = time.Now().Add(cooldown)
+	} else {
+		delete(q.keys, key)
+	}
+	return nil
+}
+
+func (m *memoryBackend) Retry(queue string, b, retried []byte, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	var ok bool
+	if q.processing, ok = take(q.processing, b); ok {
+		q.scheduled = append(q.scheduled, memoryEntry{b: retried, at: at})
+	}
+	return nil
+}
+
+func (m *memoryBackend) Bury(queue string, b, dead []byte, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	var ok bool
+	if q.processing, ok = take(q.processing, b); ok {
+		q.dead = append([][]byte{dead}, q.dead...)
+	}
+	delete(q.keys, key)
+	return nil
+}
+
+func (m *memoryBackend) Unbury(queue string, b, requeued []byte, lane, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	for i := range q.dead {
+		if !bytes.Equal(q.dead[i], b) {
+			continue
+		}
+		q.dead = append(q.dead[:i], q.dead[i+1:]...)
+		q.lanes[lane] = append(q.lanes[lane], requeued)
+		if key != "" {
+			q.keys[key] = time.Now().Add(dedupTTL)
+		}
+		m.notify()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *memoryBackend) Dead(queue string, n int) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dead := m.queue(queue).dead
+	if n >= 0 && n < len(dead) {
+		dead = dead[:n]
+	}
+	return append([][]byte(nil), dead...), nil
+}
+
+func (m *memoryBackend) Promote(queue string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	var later []memoryEntry
+	for _, e := range q.scheduled {
+		if e.at.After(now) {
+			later = append(later, e)
+			continue
+		}
+		lane, err := laneOf(queue, e.b)
+		if err != nil {
+			return err
+		}
+		q.lanes[lane] = append(q.lanes[lane], e.b)
+		m.notify()
+	}
+	q.scheduled = later
+	return nil
+}
+
+func (m *memoryBackend) RequeueAbandoned(queue string, deadline time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	var claimed []memoryEntry
+	for _, e := range q.processing {
+		if !e.at.Before(deadline) {
+			claimed = append(claimed, e)
+			continue
+		}
+		lane, err := laneOf(queue, e.b)
+		if err != nil {
+			return err
+		}
+		log.Printf("requeued payload abandoned in %s-processing: %s", queue, e.b)
+		q.lanes[lane] = append(q.lanes[lane], e.b)
+		m.notify()
+	}
+	q.processing = claimed
+
+	now := time.Now()
+	for key, expires := range q.keys {
+		if !now.Before(expires) {
+			delete(q.keys, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) Counts(queue string) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	counts := make(map[string]int64)
+	for _, lane := range lanes(queue) {
+		counts[lane] = int64(len(q.lanes[lane]))
+	}
+	counts[queue+"-processing"] = int64(len(q.processing))
+	counts[queue+"-scheduled"] = int64(len(q.scheduled))
+	counts[queue+"-dead"] = int64(len(q.dead))
+	return counts, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// postgresBackend keeps payloads in the jobs table, where list is the lane,
+// processing, scheduled or dead list the payload is in and key the key of the
+// payload, and keys in the job_keys table. Consumers pop with for update skip
+// locked, so that they never block on each other.
+type postgresBackend struct{ db *sqlx.DB }
+
+func newPostgresBackend(db *sqlx.DB) *postgresBackend { return &postgresBackend{db: db} }
+
+// matchJob is the where clause selecting the first job of queue $1 in list $2
+// with body $3. $3 is cast, or md5 would resolve it as text.
+const matchJob = `queue = $1 and list = $2 and md5(body) = md5($3::bytea) and body = $3::bytea`
+
+func (pb *postgresBackend) Push(queue, lane, key string, b []byte) (bool, error) {
+	tx, err := pb.db.Beginx()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`insert into job_keys values($1, $2, $3)
+	on conflict (queue, key) do update
+	set expires_at = excluded.expires_at
+	where job_keys.expires_at < now()`, queue, key, time.Now().Add(dedupTTL))
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, errors.WithStack(err)
+	} else if n == 0 {
+		// move the job pending in a lane of lower priority, if any
+		res, err := tx.Exec(`update jobs set lane = $3, list = $3, body = $4
+		where id = (
+			select id from jobs where queue = $1 and key = $2 and list = any($5::text[])
+			limit 1 for update skip locked
+		)`, queue, key, lane, b, pq.Array(lowerLanes(queue, lane)))
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return false, errors.WithStack(err)
+		} else if n == 0 {
+			return false, nil
+		}
+		return true, errors.WithStack(tx.Commit())
+	}
+
+	if _, err := tx.Exec(`insert into jobs(queue, lane, list, body, key) values($1, $2, $2, $3, $4)`,
+		queue, lane, b, key,
+	); err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, errors.WithStack(tx.Commit())
+}
+
+func (pb *postgresBackend) Pop(queue string, lanes []string, wait time.Duration) ([]byte, string, error) {
+	b, lane, err := pb.pop(queue, lanes)
+	if err != nil || b != nil {
+		return b, lane, err
+	}
+	time.Sleep(wait)
+	return pb.pop(queue, lanes)
+}
+
+// pop claims the oldest job of the first lane of lanes that has one. Lanes are
+// tried one by one so that each lookup uses the (queue, list, id) index.
+func (pb *postgresBackend) pop(queue string, lanes []string) ([]byte, string, error) {
+	for _, lane := range lanes {
+		var body []byte
+		if err := pb.db.Get(&body, `with next as (
+			select id from jobs
+			where queue = $1 and list = $2
+			order by id
+			limit 1
+			for update skip locked
+		)
+		update jobs set list = $3, claimed_at = now()
+		from next where jobs.id = next.id
+		returning body`,
+			queue, lane, queue+"-processing",
+		); err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, "", errors.WithStack(err)
+		}
+		return body, lane, nil
+	}
+	return nil, "", nil
+}
+
+func (pb *postgresBackend) Claim(queue string, b []byte) error {
+	_, err := pb.db.Exec(`update jobs set claimed_at = now() where `+matchJob,
+		queue, queue+"-processing", b)
+	return errors.WithStack(err)
+}
+
+func (pb *postgresBackend) Ack(queue string, b []byte, key string, cooldown time.Duration) error {
+	if _, err := pb.db.Exec(`delete from jobs where id = (
+		select id from jobs where `+matchJob+` limit 1 for update skip locked)`,
+		queue, queue+"-processing", b,
+	); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if cooldown > 0 {
+		_, err := pb.db.Exec(`update job_keys set expires_at = $3 where queue = $1 and key = $2`,
+			queue, key, time.Now().Add(cooldown))
+		return errors.WithStack(err)
+	}
+	_, err := pb.db.Exec(`delete from job_keys where queue = $1 and key = $2`, queue, key)
+	return errors.WithStack(err)
+}
+
+func (pb *postgresBackend) Retry(queue string, b, retried []byte, at time.Time) error {
+	_, err := pb.db.Exec(`update jobs set list = $4, body = $5, run_at = $6, claimed_at = null
+	where id = (select id from jobs where `+matchJob+` limit 1 for update skip locked)`,
+		queue, queue+"-processing", b, queue+"-scheduled", retried, at)
+	return errors.WithStack(err)
+}
+
+func (pb *postgresBackend) Bury(queue string, b, dead []byte, key string) error {
+	if _, err := pb.db.Exec(`update jobs set list = $4, body = $5, claimed_at = null
+	where id = (select id from jobs where `+matchJob+` limit 1 for update skip locked)`,
+		queue, queue+"-processing", b, queue+"-dead", dead,
+	); err != nil {
+		return errors.WithStack(err)
+	}
+	// let the target be published again
+	_, err := pb.db.Exec(`delete from job_keys where queue = $1 and key = $2`, queue, key)
+	return errors.WithStack(err)
+}
+
+func (pb *postgresBackend) Unbury(queue string, b, requeued []byte, lane, key string) (bool, error) {
+	tx, err := pb.db.Beginx()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`update jobs set list = lane, body = $4
+	where id = (select id from jobs where `+matchJob+` limit 1 for update skip locked)`,
+		queue, queue+"-dead", b, requeued)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, errors.WithStack(err)
+	} else if n == 0 {
+		return false, nil
+	}
+
+	if key != "" {
+		if _, err := tx.Exec(`insert into job_keys values($1, $2, $3)
+		on conflict (queue, key) do update set expires_at = excluded.expires_at`,
+			queue, key, time.Now().Add(dedupTTL),
+		); err != nil {
+			return false, errors.WithStack(err)
+		}
+	}
+	return true, errors.WithStack(tx.Commit())
+}
+
+func (pb *postgresBackend) Dead(queue string, n int) ([][]byte, error) {
+	limit := sql.NullInt64{Int64: int64(n), Valid: n >= 0}
+	var dest [][]byte
+	err := pb.db.Select(&dest,
+		`select body from jobs where queue = $1 and list = $2 order by id desc limit $3`,
+		queue, queue+"-dead", limit)
+	return dest, errors.WithStack(err)
+}
+
+func (pb *postgresBackend) Promote(queue string, now time.Time) error {
+	_, err := pb.db.Exec(`update jobs set list = lane, run_at = null
+	where queue = $1 and list = $2 and run_at <= $3`,
+		queue, queue+"-scheduled", now)
+	return errors.WithStack(err)
+}
+
+func (pb *postgresBackend) RequeueAbandoned(queue string, deadline time.Time) error {
+	res, err := pb.db.Exec(`update jobs set list = lane, claimed_at = null
+	where queue = $1 and list = $2 and claimed_at < $3`,
+		queue, queue+"-processing", deadline)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("requeued %d payloads abandoned in %s-processing", n, queue)
+	}
+
+	_, err = pb.db.Exec(`delete from job_keys where queue = $1 and expires_at < now()`, queue)
+	return errors.WithStack(err)
+}
+
+func (pb *postgresBackend) Counts(queue string) (map[string]int64, error) {
+	var dest []struct {
+		List  string
+		Count int64
+	}
+	if err := pb.db.Select(&dest,
+		`select list, count(*) from jobs where queue = $1 group by list`, queue,
+	); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	counts := make(map[string]int64)
+	for _, list := range lists(queue) {
+		counts[list] = 0
+	}
+	for _, d := range dest {
+		counts[d.List] = d.Count
+	}
+	return counts, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// redisBackend keeps lanes, processing and dead payloads in lists, scheduled
+// payloads in a sorted set scored by due time, and claims in a hash from
+// payload to claim time. The dedup key of a pending payload holds the payload,
+// and "done" during its cooldown.
+type redisBackend struct{ redis *redis.Client }
+
+func newRedisBackend(redis *redis.Client) *redisBackend { return &redisBackend{redis: redis} }
+
+func dedupKey(queue, key string) string { return queue + "-dedup:" + key }
+
+func (rb *redisBackend) Push(queue, lane, key string, b []byte) (bool, error) {
+	dedup := dedupKey(queue, key)
+	ok, err := rb.redis.SetNX(dedup, b, dedupTTL).Result()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if !ok {
+		return rb.raise(queue, lane, dedup, b)
+	}
+
+	if err := rb.redis.LPush(lane, b).Err(); err != nil {
+		rb.redis.Del(dedup)
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// raiseScript replaces ARGV[1] in the list KEYS[2] with ARGV[2] in the list
+// KEYS[3], if the dedup key KEYS[1] still holds ARGV[1], and sets KEYS[1] to
+// ARGV[2] for ARGV[3] milliseconds. It returns 0 if ARGV[1] was not pending in
+// KEYS[2] anymore.
+var raiseScript = redis.NewScript(`
+if redis.call('get', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if redis.call('lrem', KEYS[2], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('lpush', KEYS[3], ARGV[2])
+redis.call('set', KEYS[1], ARGV[2], 'px', ARGV[3])
+return 1`)
+
+// raise replaces the payload pending with the dedup key with b in lane, if
+// it waits in a lane of lower priority.
+func (rb *redisBackend) raise(queue, lane, dedup string, b []byte) (bool, error) {
+	pending, err := rb.redis.Get(dedup).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if string(pending) == "done" || string(pending) == "pending" {
+		// in cooldown, or pushed by an older version
+		return false, nil
+	}
+	pendingLane, err := laneOf(queue, pending)
+	if err != nil {
+		return false, err
+	}
+	if !contains(lowerLanes(queue, lane), pendingLane) {
+		return false, nil
+	}
+
+	moved, err := raiseScript.Run(rb.redis, []string{dedup, pendingLane, lane},
+		pending, b, int64(dedupTTL/time.Millisecond)).Result()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return moved.(int64) == 1, nil
+}
+
+func (rb *redisBackend) Pop(queue string, lanes []string, wait time.Duration) ([]byte, string, error) {
+	processing := queue + "-processing"
+	b, lane, err := rb.pop(processing, lanes, wait)
+	if err == redis.Nil {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	return b, lane, rb.Claim(queue, b)
+}
+
+func (rb *redisBackend) pop(processing string, lanes []string, wait time.Duration) ([]byte, string, error) {
+	for _, lane := range lanes {
+		b, err := rb.redis.RPopLPush(lane, processing).Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		return b, lane, nil
+	}
+
+	// all lanes are empty: wait a bit for a payload in the first lane, the
+	// other ones are polled again on the next call
+	b, err := rb.redis.BRPopLPush(lanes[0], processing, wait).Bytes()
+	return b, lanes[0], err
+}
+
+func (rb *redisBackend) Claim(queue string, b []byte) error {
+	return errors.WithStack(
+		rb.redis.HSet(queue+"-processing-claims", string(b), time.Now().Unix()).Err())
+}
+
+func (rb *redisBackend) Ack(queue string, b []byte, key string, cooldown time.Duration) error {
+	processing := queue + "-processing"
+	if err := rb.redis.LRem(processing, 1, b).Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := rb.redis.HDel(processing+"-claims", string(b)).Err(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if key == "" {
+		return nil
+	}
+	if cooldown > 0 {
+		return errors.WithStack(rb.redis.Set(dedupKey(queue, key), "done", cooldown).Err())
+	}
+	return errors.WithStack(rb.redis.Del(dedupKey(queue, key)).Err())
+}
+
+// retryScript moves ARGV[1] from the processing list KEYS[1] to either the
+// scheduled sorted set KEYS[2] with score ARGV[3], or the dead list KEYS[3],
+// as ARGV[2].
+var retryScript = redis.NewScript(`
+if redis.call('lrem', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+if ARGV[3] == '' then
+	redis.call('lpush', KEYS[3], ARGV[2])
+else
+	redis.call('zadd', KEYS[2], ARGV[3], ARGV[2])
+end
+return 1`)
+
+func (rb *redisBackend) Retry(queue string, b, retried []byte, at time.Time) error {
+	return rb.retry(queue, b, retried, strconv.FormatInt(at.Unix(), 10))
+}
+
+func (rb *redisBackend) Bury(queue string, b, dead []byte, key string) error {
+	if err := rb.retry(queue, b, dead, ""); err != nil {
+		return err
+	}
+	if key == "" {
+		return nil
+	}
+	// let the target be published again
+	return errors.WithStack(rb.redis.Del(dedupKey(queue, key)).Err())
+}
+
+func (rb *redisBackend) retry(queue string, b, retried []byte, runAt string) error {
+	processing := queue + "-processing"
+	if err := retryScript.Run(rb.redis,
+		[]string{processing, queue + "-scheduled", queue + "-dead"},
+		b, retried, runAt,
+	).Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(rb.redis.HDel(processing+"-claims", string(b)).Err())
+}
+
+// requeueScript moves one occurrence of ARGV[1] from KEYS[1] to KEYS[2],
+// replaced by ARGV[2] if given, and returns 0 if it was not in KEYS[1] anymore.
+var requeueScript = redis.NewScript(`
+if redis.call('lrem', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('rpush', KEYS[2], ARGV[2] or ARGV[1])
+return 1`)
+
+func (rb *redisBackend) Unbury(queue string, b, requeued []byte, lane, key string) (bool, error) {
+	moved, err := requeueScript.Run(rb.redis, []string{queue + "-dead", lane}, b, requeued).Result()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if moved.(int64) == 0 {
+		return false, nil
+	}
+	if key == "" {
+		return true, nil
+	}
+	return true, errors.WithStack(rb.redis.Set(dedupKey(queue, key), requeued, dedupTTL).Err())
+}
+
+func (rb *redisBackend) Dead(queue string, n int) ([][]byte, error) {
+	stop := int64(n - 1)
+	if n < 0 {
+		stop = -1
+	}
+	ss, err := rb.redis.LRange(queue+"-dead", 0, stop).Result()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	bs := make([][]byte, len(ss))
+	for i := range ss {
+		bs[i] = []byte(ss[i])
+	}
+	return bs, nil
+}
+
+// promoteScript moves ARGV[1] from the sorted set KEYS[1] to the list KEYS[2],
+// and returns 0 if it was not in KEYS[1] anymore.
+var promoteScript = redis.NewScript(`
+if redis.call('zrem', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('lpush', KEYS[2], ARGV[1])
+return 1`)
+
+func (rb *redisBackend) Promote(queue string, now time.Time) error {
+	scheduled := queue + "-scheduled"
+	due, err := rb.redis.ZRangeByScore(scheduled, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, payload := range due {
+		lane, err := laneOf(queue, []byte(payload))
+		if err != nil {
+			return err
+		}
+		if err := promoteScript.Run(rb.redis, []string{scheduled, lane}, payload).Err(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (rb *redisBackend) RequeueAbandoned(queue string, deadline time.Time) error {
+	processing := queue + "-processing"
+	claims := processing + "-claims"
+
+	payloads, err := rb.redis.LRange(processing, 0, -1).Result()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	claimed, err := rb.redis.HGetAll(claims).Result()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	inProcessing := make(map[string]bool, len(payloads))
+	for _, payload := range payloads {
+		inProcessing[payload] = true
+
+		ts, ok := claimed[payload]
+		if !ok {
+			// the process died between RPopLPush and claim, or the payload
+			// was claimed by an older version: start the clock now
+			if err := rb.redis.HSetNX(claims, payload, time.Now().Unix()).Err(); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !time.Unix(sec, 0).Before(deadline) {
+			continue
+		}
+
+		lane, err := laneOf(queue, []byte(payload))
+		if err != nil {
+			return err
+		}
+		moved, err := requeueScript.Run(rb.redis, []string{processing, lane}, payload).Result()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if moved.(int64) == 1 {
+			log.Printf("requeued payload abandoned in %s: %s", processing, payload)
+		}
+	}
+
+	// forget about claims whose payload left processing
+	var stale []string
+	for payload := range claimed {
+		if !inProcessing[payload] {
+			stale = append(stale, payload)
+		}
+	}
+	if len(stale) > 0 {
+		return errors.WithStack(rb.redis.HDel(claims, stale...).Err())
+	}
+	return nil
+}
+
+func (rb *redisBackend) Counts(queue string) (map[string]int64, error) {
+	lists := lists(queue)
+	cmds := make([]*redis.IntCmd, len(lists))
+	if _, err := rb.redis.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, list := range lists {
+			if list == queue+"-scheduled" {
+				cmds[i] = pipe.ZCard(list)
+			} else {
+				cmds[i] = pipe.LLen(list)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	counts := make(map[string]int64, len(lists))
+	for i, list := range lists {
+		counts[list] = cmds[i].Val()
+	}
+	return counts, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, newMemoryBackend(), func(string) error { return nil })
+}
+
+func TestMemoryBackendForgetsExpiredKeys(t *testing.T) {
+	m := newMemoryBackend()
+	mustPush(t, m, "test", priorityDefault, "expired", true)
+	mustPush(t, m, "test", priorityDefault, "pending", true)
+	m.queue("test").keys["expired"] = time.Now().Add(-time.Second)
+
+	if err := m.RequeueAbandoned("test", time.Now()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	keys := m.queue("test").keys
+	if _, ok := keys["expired"]; ok || len(keys) != 1 {
+		t.Fatalf("keys = %v, want only pending", keys)
+	}
+}
+
+func TestPostgresBackend(t *testing.T) {
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	db := sqlx.MustConnect("postgres", databaseURL)
+	defer db.Close()
+	if err := migrateUp(context.Background(), db); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testBackend(t, newPostgresBackend(db), func(queue string) error {
+		if _, err := db.Exec(`delete from jobs where queue = $1`, queue); err != nil {
+			return err
+		}
+		_, err := db.Exec(`delete from job_keys where queue = $1`, queue)
+		return err
+	})
+}
+
+func TestRedisBackend(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(opts)
+	defer client.Close()
+	testBackend(t, newRedisBackend(client), func(queue string) error {
+		keys, err := client.Keys(queue + "*").Result()
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		return client.Del(keys...).Err()
+	})
+}
+
+// testBackend runs the contract of backend against b. Each test uses its own
+// queue, which clean removes.
+func testBackend(t *testing.T, b backend, clean func(queue string) error) {
+	for _, test := range []struct {
+		name string
+		f    func(*testing.T, backend, string)
+	}{
+		{"push deduplicates keys", testPushDedup},
+		{"push raises lanes", testPushRaise},
+		{"pop follows lane order", testPopLaneOrder},
+		{"ack starts cooldown", testAckCooldown},
+		{"retry then promote", testRetryPromote},
+		{"bury then unbury", testBuryUnbury},
+		{"requeue abandoned", testRequeueAbandoned},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			queue := fmt.Sprintf("test-%d", time.Now().UnixNano())
+			defer func() {
+				if err := clean(queue); err != nil {
+					t.Errorf("couldn't clean %s: %v", queue, err)
+				}
+			}()
+			test.f(t, b, queue)
+		})
+	}
+}
+
+// testPayload returns the body of a payload with key, published with prio.
+func testPayload(t *testing.T, key string, prio priority) []byte {
+	b, err := payload{Type: "user", Key: key, Priority: prio, Payload: json.RawMessage(`{}`)}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func mustPush(t *testing.T, b backend, queue string, prio priority, key string, want bool) []byte {
+	t.Helper()
+	body := testPayload(t, key, prio)
+	pushed, err := b.Push(queue, lane(queue, prio), key, body)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if pushed != want {
+		t.Fatalf("Push(%q) = %v, want %v", key, pushed, want)
+	}
+	return body
+}
+
+// mustPop pops the next payload of queue, and fails unless it is want in
+// wantLane. A nil want expects queue to be empty.
+func mustPop(t *testing.T, b backend, queue string, want []byte, wantLane string) {
+	t.Helper()
+	body, lane, err := b.Pop(queue, lanes(queue), time.Second)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(body, want) {
+		t.Fatalf("Pop() = %s, want %s", body, want)
+	}
+	if want != nil && lane != wantLane {
+		t.Fatalf("Pop() lane = %s, want %s", lane, wantLane)
+	}
+}
+
+func mustCount(t *testing.T, b backend, queue string, want map[string]int64) {
+	t.Helper()
+	counts, err := b.Counts(queue)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, list := range lists(queue) {
+		if counts[list] != want[list] {
+			t.Errorf("Counts()[%s] = %d, want %d", list, counts[list], want[list])
+		}
+	}
+}
+
+func testPushDedup(t *testing.T, b backend, queue string) {
+	mustPush(t, b, queue, priorityDefault, "a", true)
+	mustPush(t, b, queue, priorityDefault, "a", false)
+	mustPush(t, b, queue, priorityBackfill, "a", false)
+	mustPush(t, b, queue, priorityDefault, "b", true)
+	mustCount(t, b, queue, map[string]int64{queue: 2})
+}
+
+func testPushRaise(t *testing.T, b backend, queue string) {
+	mustPush(t, b, queue, priorityBackfill, "a", true)
+	mustPush(t, b, queue, priorityDefault, "a", true)
+	mustCount(t, b, queue, map[string]int64{queue: 1})
+	mustPush(t, b, queue, priorityBackfill, "a", false)
+	interactive := mustPush(t, b, queue, priorityInteractive, "a", true)
+	mustCount(t, b, queue, map[string]int64{lane(queue, priorityInteractive): 1})
+	mustPop(t, b, queue, interactive, lane(queue, priorityInteractive))
+
+	// processing payloads stay where they are
+	mustPush(t, b, queue, priorityInteractive, "a", false)
+	mustCount(t, b, queue, map[string]int64{queue + "-processing": 1})
+}
+
+func testPopLaneOrder(t *testing.T, b backend, queue string) {
+	backfill := mustPush(t, b, queue, priorityBackfill, "backfill", true)
+	first := mustPush(t, b, queue, priorityDefault, "first", true)
+	second := mustPush(t, b, queue, priorityDefault, "second", true)
+	interactive := mustPush(t, b, queue, priorityInteractive, "interactive", true)
+
+	mustPop(t, b, queue, interactive, lane(queue, priorityInteractive))
+	mustPop(t, b, queue, first, queue)
+	mustPop(t, b, queue, second, queue)
+	mustPop(t, b, queue, backfill, lane(queue, priorityBackfill))
+	mustPop(t, b, queue, nil, "")
+	mustCount(t, b, queue, map[string]int64{queue + "-processing": 4})
+}
+
+func testAckCooldown(t *testing.T, b backend, queue string) {
+	cooled := mustPush(t, b, queue, priorityDefault, "cooled", true)
+	mustPop(t, b, queue, cooled, queue)
+	if err := b.Ack(queue, cooled, "cooled", time.Hour); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mustPush(t, b, queue, priorityDefault, "cooled", false)
+
+	forgotten := mustPush(t, b, queue, priorityDefault, "forgotten", true)
+	mustPop(t, b, queue, forgotten, queue)
+	if err := b.Ack(queue, forgotten, "forgotten", 0); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mustPush(t, b, queue, priorityDefault, "forgotten", true)
+	mustCount(t, b, queue, map[string]int64{queue: 1})
+}
+
+func testRetryPromote(t *testing.T, b backend, queue string) {
+	body := mustPush(t, b, queue, priorityBackfill, "a", true)
+	mustPop(t, b, queue, body, lane(queue, priorityBackfill))
+
+	retried := testPayload(t, "a", priorityBackfill)
+	retried = append(retried[:len(retried)-1], []byte(`,"Attempts":1}`)...)
+	now := time.Now()
+	if err := b.Retry(queue, body, retried, now.Add(time.Hour)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mustCount(t, b, queue, map[string]int64{queue + "-scheduled": 1})
+	mustPush(t, b, queue, priorityBackfill, "a", false)
+
+	if err := b.Promote(queue, now); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mustCount(t, b, queue, map[string]int64{queue + "-scheduled": 1})
+	if err := b.Promote(queue, now.Add(2*time.Hour)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mustPop(t, b, queue, retried, lane(queue, priorityBackfill))
+}
+
+func testBuryUnbury(t *testing.T, b backend, queue string) {
+	body := mustPush(t, b, queue, priorityDefault, "a", true)
+	mustPop(t, b, queue, body, queue)
+
+	dead := testPayload(t, "a", priorityDefault)
+	dead = append(dead[:len(dead)-1], []byte(`,"Attempts":6}`)...)
+	if err := b.Bury(queue, body, dead, "a"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mustCount(t, b, queue, map[string]int64{queue + "-dead": 1})
+	got, err := b.Dead(queue, -1)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0], dead) {
+		t.Fatalf("Dead() = %q, want [%s]", got, dead)
+	}
+
+	requeued := testPayload(t, "a", priorityDefault)
+	for _, want := range []bool{true, false} {
+		ok, err := b.Unbury(queue, dead, requeued, queue, "a")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if ok != want {
+			t.Fatalf("Unbury() = %v, want %v", ok, want)
+		}
+	}
+	mustPush(t, b, queue, priorityDefault, "a", false)
+	mustPop(t, b, queue, requeued, queue)
+	mustCount(t, b, queue, map[string]int64{queue + "-processing": 1})
+}
+
+func testRequeueAbandoned(t *testing.T, b backend, queue string) {
+	abandoned := mustPush(t, b, queue, priorityInteractive, "abandoned", true)
+	mustPop(t, b, queue, abandoned, lane(queue, priorityInteractive))
+
+	if err := b.RequeueAbandoned(queue, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mustCount(t, b, queue, map[string]int64{queue + "-processing": 1})
+
+	if err := b.RequeueAbandoned(queue, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mustCount(t, b, queue, map[string]int64{lane(queue, priorityInteractive): 1})
+	mustPop(t, b, queue, abandoned, lane(queue, priorityInteractive))
+}
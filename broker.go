@@ -1,22 +1,128 @@
 package main
 
 import (
-	"github.com/go-redis/redis"
+	"encoding/json"
+
 	"github.com/pkg/errors"
 )
 
-type broker struct{ redis *redis.Client }
+// priority selects the lane of a queue a payload is published to.
+type priority int
+
+const (
+	priorityDefault     priority = iota // pagination
+	priorityInteractive                 // first pages, triggered by page views
+	priorityBackfill                    // comments of issues
+)
+
+// lane returns the list of queue for the payloads of priority p.
+func lane(queue string, p priority) string {
+	switch p {
+	case priorityInteractive:
+		return queue + "-interactive"
+	case priorityBackfill:
+		return queue + "-backfill"
+	}
+	return queue
+}
+
+// lanes returns the lists of queue, by decreasing priority.
+func lanes(queue string) []string {
+	return []string{
+		lane(queue, priorityInteractive),
+		lane(queue, priorityDefault),
+		lane(queue, priorityBackfill),
+	}
+}
+
+// lowerLanes returns the lanes of queue with a lower priority than lane.
+func lowerLanes(queue, lane string) []string {
+	all := lanes(queue)
+	for i := range all {
+		if all[i] == lane {
+			return all[i+1:]
+		}
+	}
+	return nil
+}
+
+// laneOf returns the list of queue that payload b belongs to.
+func laneOf(queue string, b []byte) (string, error) {
+	var p payload
+	if err := json.Unmarshal(b, &p); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return lane(queue, p.Priority), nil
+}
+
+type broker struct{ backend backend }
 
-func newBroker(redis *redis.Client) *broker { return &broker{redis: redis} }
+func newBroker(backend backend) *broker { return &broker{backend: backend} }
 
-func (b *broker) Publish(queue string, value interface{}) error {
-	length, err := b.redis.LPush(queue, value).Result()
+// Publish pushes j to the lane of queue for prio. It is skipped while a
+// payload with the same key is pending, or was completed during its cooldown,
+// unless the pending payload waits in a lane of lower priority: it is then
+// moved to the lane for prio.
+func (b *broker) Publish(queue string, prio priority, j job) error {
+	p, err := newPayload(j, prio)
+	if err != nil {
+		return err
+	}
+	raw, err := p.MarshalBinary()
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	_, err = b.backend.Push(queue, lane(queue, prio), p.Key, raw)
+	return err
+}
 
-	if err := b.redis.Set(queue+"-count", length, 0).Err(); err != nil {
-		return errors.WithStack(err)
+// Dead returns the n most recent dead payloads of queue.
+func (b *broker) Dead(queue string, n int) ([]payload, error) {
+	dead, err := b.backend.Dead(queue, n)
+	if err != nil {
+		return nil, err
+	}
+	payloads := make([]payload, len(dead))
+	for i := range dead {
+		if err := json.Unmarshal(dead[i], &payloads[i]); err != nil {
+			return nil, errors.WithStack(err)
+		}
 	}
-	return b.redis.Publish(queue+"-count", length).Err()
+	return payloads, nil
+}
+
+// RequeueDead moves every dead payload of queue back to its lane, with its
+// attempts reset.
+func (b *broker) RequeueDead(queue string) (int, error) {
+	dead, err := b.backend.Dead(queue, -1)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, raw := range dead {
+		var p payload
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return n, errors.WithStack(err)
+		}
+		p.Attempts, p.LastError, p.FailedAt = 0, "", nil
+		requeued, err := p.MarshalBinary()
+		if err != nil {
+			return n, errors.WithStack(err)
+		}
+
+		ok, err := b.backend.Unbury(queue, raw, requeued, lane(queue, p.Priority), p.Key)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Counts returns the number of payloads in each list of queue.
+func (b *broker) Counts(queue string) (map[string]int64, error) {
+	return b.backend.Counts(queue)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -8,28 +9,50 @@ import (
 	"github.com/pkg/errors"
 )
 
-type cache struct{ redis *redis.Client }
+// kv is the storage of cache. It is implemented by redisKV, and memoryKV for
+// installs without Redis.
+type kv interface {
+	Incr(key string) (int64, error)
+	LPush(key string, value interface{}) error
+	LTrim(key string, start, stop int64) error
+	LRange(key string, start, stop int64) ([]string, error)
+	Publish(channel string, message interface{}) error
+	PSubscribe(patterns ...string) subscription
+	Get(key string) ([]byte, error)
+	Set(key string, value interface{}, expiration time.Duration) error
+}
+
+// subscription receives the messages published to the channels matching the
+// patterns given to kv.PSubscribe.
+type subscription interface {
+	Channel() <-chan message
+	Close() error
+}
+
+type message struct{ Channel, Pattern, Payload string }
+
+type cache struct{ kv }
 
-func newCache(redis *redis.Client) *cache { return &cache{redis: redis} }
+func newCache(kv kv) *cache { return &cache{kv: kv} }
 
-func (c *cache) Incr(key string) (int64, error) {
+type redisKV struct{ redis *redis.Client }
+
+func newRedisKV(redis *redis.Client) *redisKV { return &redisKV{redis: redis} }
+
+func (c *redisKV) Incr(key string) (int64, error) {
 	val, err := c.redis.Incr(key).Result()
 	return val, errors.WithStack(err)
 }
-func (c *cache) IncrBy(key string, value int64) (int64, error) {
-	val, err := c.redis.IncrBy(key, value).Result()
-	return val, errors.WithStack(err)
-}
 
-func (c *cache) LPush(key string, value interface{}) error {
+func (c *redisKV) LPush(key string, value interface{}) error {
 	return errors.WithStack(c.redis.LPush(key, value).Err())
 }
 
-func (c *cache) LTrim(key string, start, stop int64) error {
+func (c *redisKV) LTrim(key string, start, stop int64) error {
 	return errors.WithStack(c.redis.LTrim(key, start, stop).Err())
 }
 
-func (c *cache) LRange(key string, start, stop int64) ([]string, error) {
+func (c *redisKV) LRange(key string, start, stop int64) ([]string, error) {
 	ss, err := c.redis.LRange(key, start, stop).Result()
 	if err == redis.Nil {
 		return nil, nil
@@ -37,11 +60,39 @@ func (c *cache) LRange(key string, start, stop int64) ([]string, error) {
 	return ss, errors.WithStack(err)
 }
 
-func (c *cache) Publish(channel string, message interface{}) error {
+func (c *redisKV) Publish(channel string, message interface{}) error {
 	return errors.WithStack(c.redis.Publish(channel, message).Err())
 }
 
-func (c *cache) Get(key string) ([]byte, error) {
+func (c *redisKV) PSubscribe(patterns ...string) subscription {
+	pubsub := c.redis.PSubscribe(patterns...)
+	s := &redisSubscription{pubsub: pubsub, c: make(chan message), done: make(chan struct{})}
+	go func() {
+		for msg := range pubsub.Channel() {
+			select {
+			case s.c <- message{Channel: msg.Channel, Pattern: msg.Pattern, Payload: msg.Payload}:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+type redisSubscription struct {
+	pubsub *redis.PubSub
+	c      chan message
+	done   chan struct{}
+}
+
+func (s *redisSubscription) Channel() <-chan message { return s.c }
+
+func (s *redisSubscription) Close() error {
+	close(s.done)
+	return errors.WithStack(s.pubsub.Close())
+}
+
+func (c *redisKV) Get(key string) ([]byte, error) {
 	b, err := c.redis.Get(key).Bytes()
 	if err == redis.Nil {
 		return nil, nil
@@ -49,7 +100,7 @@ func (c *cache) Get(key string) ([]byte, error) {
 	return b, errors.WithStack(err)
 }
 
-func (c *cache) Set(key string, value interface{}, expiration time.Duration) error {
+func (c *redisKV) Set(key string, value interface{}, expiration time.Duration) error {
 	return errors.WithStack(c.redis.Set(key, value, expiration).Err())
 }
 
@@ -67,6 +118,7 @@ func (c *cache) sendToRequestLog(message string, opts github.ListOptions, resp *
 		StatusCode:  resp.StatusCode,
 		LastPage:    resp.LastPage,
 		Duration:    duration,
+		Cached:      resp.Header.Get("X-From-Cache") == "1",
 	}
 	if err := c.LPush("github-requests", r); err != nil {
 		return err
@@ -84,3 +136,16 @@ func (c *cache) updateRate(key string, rate github.Rate) error {
 	}
 	return c.Publish(key, githubRate(rate))
 }
+
+// rate returns the rate stored by updateRate, or nil once it has reset.
+func (c *cache) rate(key string) (*github.Rate, error) {
+	b, err := c.Get(key)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	var rate github.Rate
+	if err := json.Unmarshal(b, &rate); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &rate, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// memoryKV implements kv in process memory, for installs without Redis.
+type memoryKV struct {
+	mu     sync.Mutex
+	values map[string]memoryValue
+	lists  map[string][]string
+	subs   map[*memorySubscription]bool
+}
+
+type memoryValue struct {
+	b       []byte
+	expires time.Time
+}
+
+func newMemoryKV() *memoryKV {
+	return &memoryKV{
+		values: make(map[string]memoryValue),
+		lists:  make(map[string][]string),
+		subs:   make(map[*memorySubscription]bool),
+	}
+}
+
+// bytesOf converts value the way go-redis does.
+func bytesOf(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case encoding.BinaryMarshaler:
+		b, err := v.MarshalBinary()
+		return b, errors.WithStack(err)
+	default:
+		return []byte(fmt.Sprint(v)), nil
+	}
+}
+
+func (m *memoryKV) Incr(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	if v, ok := m.get(key); ok {
+		var err error
+		n, err = strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	n++
+	m.values[key] = memoryValue{b: []byte(strconv.FormatInt(n, 10))}
+	return n, nil
+}
+
+func (m *memoryKV) LPush(key string, value interface{}) error {
+	b, err := bytesOf(value)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lists[key] = append([]string{string(b)}, m.lists[key]...)
+	return nil
+}
+
+// bounds converts the Redis style inclusive range [start, stop] to a slice
+// range of a list of length n.
+func bounds(n int, start, stop int64) (int, int) {
+	if start < 0 {
+		start += int64(n)
+	}
+	if stop < 0 {
+		stop += int64(n)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= int64(n) {
+		stop = int64(n) - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return int(start), int(stop) + 1
+}
+
+func (m *memoryKV) LTrim(key string, start, stop int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.lists[key]
+	i, j := bounds(len(l), start, stop)
+	m.lists[key] = l[i:j]
+	return nil
+}
+
+func (m *memoryKV) LRange(key string, start, stop int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.lists[key]
+	i, j := bounds(len(l), start, stop)
+	return append([]string(nil), l[i:j]...), nil
+}
+
+func (m *memoryKV) Publish(channel string, msg interface{}) error {
+	b, err := bytesOf(msg)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for s := range m.subs {
+		for _, pattern := range s.patterns {
+			if ok, _ := path.Match(pattern, channel); !ok {
+				continue
+			}
+			select {
+			case s.c <- message{Channel: channel, Pattern: pattern, Payload: string(b)}:
+			default: // drop messages for slow subscribers, as Redis would eventually do
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryKV) PSubscribe(patterns ...string) subscription {
+	s := &memorySubscription{kv: m, patterns: patterns, c: make(chan message, 100)}
+	m.mu.Lock()
+	m.subs[s] = true
+	m.mu.Unlock()
+	return s
+}
+
+type memorySubscription struct {
+	kv       *memoryKV
+	patterns []string
+	c        chan message
+}
+
+func (s *memorySubscription) Channel() <-chan message { return s.c }
+
+func (s *memorySubscription) Close() error {
+	s.kv.mu.Lock()
+	delete(s.kv.subs, s)
+	s.kv.mu.Unlock()
+	return nil
+}
+
+func (m *memoryKV) get(key string) ([]byte, bool) {
+	v, ok := m.values[key]
+	if !ok {
+		return nil, false
+	}
+	if !v.expires.IsZero() && time.Now().After(v.expires) {
+		delete(m.values, key)
+		return nil, false
+	}
+	return v.b, true
+}
+
+func (m *memoryKV) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, _ := m.get(key)
+	return b, nil
+}
+
+func (m *memoryKV) Set(key string, value interface{}, expiration time.Duration) error {
+	b, err := bytesOf(value)
+	if err != nil {
+		return err
+	}
+	v := memoryValue{b: b}
+	if expiration > 0 {
+		v.expires = time.Now().Add(expiration)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = v
+	return nil
+}
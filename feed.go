@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// feedTitle returns the title of the feed of the comments selected by
+// filter.
+func feedTitle(filter commentFilter) string {
+	title := "Top reacted GitHub comments"
+	switch {
+	case filter.Org != "":
+		title += " on " + filter.Org + " repos"
+	case filter.Repo != "":
+		title += " on " + filter.Repo
+	case filter.User != "":
+		title += " by " + filter.User
+	}
+	return title
+}
+
+// feedURLs returns the absolute URLs of the feed requested by r, and of the
+// page of the same comments.
+func feedURLs(r *http.Request) (string, string) {
+	u := *r.URL
+	u.Scheme, u.Host = "http", r.Host
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		u.Scheme = "https"
+	}
+	self := u.String()
+	q := u.Query()
+	q.Del("feed")
+	u.RawQuery = q.Encode()
+	return self, u.String()
+}
+
+// entryTitle returns the title of the feed entry of c.
+func entryTitle(c comment) string {
+	title := fmt.Sprintf("%s got %d reactions on %s", c.Comment.GetUser().GetLogin(), c.Comment.GetReactions().GetTotalCount(), c.Repo)
+	if c.Title != "" {
+		title += ": " + c.Title
+	}
+	return title
+}
+
+// entryLink returns the URL of c on GitHub, or an empty string if its scheme
+// is not safe for feed readers to follow.
+func entryLink(c comment) string {
+	if u := c.Comment.GetHTMLURL(); safeURL(u) {
+		return u
+	}
+	return ""
+}
+
+// entryContent returns the HTML content of the feed entry of c, its rendered
+// body followed by the summary of its reactions.
+func entryContent(c comment) string {
+	content := renderMarkdown(c.Comment.GetBody())
+	r := c.Comment.GetReactions()
+	var reactions []string
+	for _, reaction := range []struct {
+		count int
+		emoji string
+	}{
+		{r.GetPlusOne(), "👍"}, {r.GetMinusOne(), "👎"}, {r.GetLaugh(), "😄"},
+		{r.GetConfused(), "😕"}, {r.GetHeart(), "❤️"}, {r.GetHooray(), "🎉"},
+	} {
+		if reaction.count != 0 {
+			reactions = append(reactions, fmt.Sprintf("%d %s", reaction.count, reaction.emoji))
+		}
+	}
+	return content + "<p>" + strings.Join(reactions, " ") + "</p>"
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Link    atomLink   `xml:"link"`
+	Author  atomAuthor `xml:"author"`
+	Content atomText   `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// writeAtom writes comments as an Atom feed. Entries are identified by the
+// URL of their comment on GitHub, so that they stay the same across
+// fetches.
+func writeAtom(w http.ResponseWriter, r *http.Request, filter commentFilter, comments []comment) error {
+	self, page := feedURLs(r)
+	feed := atomFeed{
+		Title: feedTitle(filter),
+		ID:    self,
+		Links: []atomLink{{Rel: "self", Href: self}, {Rel: "alternate", Href: page}},
+	}
+	var updated time.Time
+	for _, c := range comments {
+		if c.Comment.GetUpdatedAt().After(updated) {
+			updated = c.Comment.GetUpdatedAt()
+		}
+		login := c.Comment.GetUser().GetLogin()
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   entryTitle(c),
+			ID:      c.Comment.GetHTMLURL(),
+			Updated: c.Comment.GetUpdatedAt().Format(time.RFC3339),
+			Link:    atomLink{Rel: "alternate", Href: entryLink(c)},
+			Author:  atomAuthor{Name: login, URI: "https://github.com/" + login},
+			Content: atomText{Type: "html", Body: entryContent(c)},
+		})
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	return writeXML(w, feed)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	Author      string  `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// writeRSS writes comments as an RSS feed, with the same stable identifiers
+// as writeAtom.
+func writeRSS(w http.ResponseWriter, r *http.Request, filter commentFilter, comments []comment) error {
+	_, page := feedURLs(r)
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       feedTitle(filter),
+			Link:        page,
+			Description: feedTitle(filter),
+		},
+	}
+	for _, c := range comments {
+		link := entryLink(c)
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       entryTitle(c),
+			Link:        link,
+			Description: entryContent(c),
+			Author:      c.Comment.GetUser().GetLogin(),
+			GUID:        rssGUID{IsPermaLink: link != "", Value: c.Comment.GetHTMLURL()},
+			PubDate:     c.Comment.GetCreatedAt().Format(time.RFC1123Z),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	return writeXML(w, feed)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) error {
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(xml.NewEncoder(w).Encode(v))
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
@@ -18,17 +20,18 @@ type fetcher struct {
 	broker       *broker
 	cache        *cache
 	store        *store
+	scheduler    *scheduler
 	githubClient *github.Client
 }
 
-func newFetcher(broker *broker, cache *cache, store *store, githubClient *github.Client) *fetcher {
-	return &fetcher{broker: broker, cache: cache, store: store, githubClient: githubClient}
+func newFetcher(broker *broker, cache *cache, store *store, scheduler *scheduler, githubClient *github.Client) *fetcher {
+	return &fetcher{broker: broker, cache: cache, store: store, scheduler: scheduler, githubClient: githubClient}
 }
 
 func (f *fetcher) fetch(ctx context.Context, b []byte) error {
 	var p payload
 	if err := json.Unmarshal(b, &p); err != nil {
-		return errors.WithStack(err)
+		return &permanentError{err: errors.WithStack(err)}
 	}
 
 	var ferr error
@@ -36,40 +39,149 @@ func (f *fetcher) fetch(ctx context.Context, b []byte) error {
 	case "user":
 		var u userPayload
 		if err := json.Unmarshal(p.Payload, &u); err != nil {
-			return errors.WithStack(err)
+			return &permanentError{err: errors.WithStack(err)}
 		}
 		ferr = f.fetchUser(ctx, u)
+	case "org":
+		var o orgPayload
+		if err := json.Unmarshal(p.Payload, &o); err != nil {
+			return &permanentError{err: errors.WithStack(err)}
+		}
+		ferr = f.fetchOrg(ctx, o)
 	case "issue":
 		var i issuePayload
 		if err := json.Unmarshal(p.Payload, &i); err != nil {
-			return errors.WithStack(err)
+			return &permanentError{err: errors.WithStack(err)}
 		}
 		ferr = f.fetchIssue(ctx, i)
+	case "pull":
+		var pr pullPayload
+		if err := json.Unmarshal(p.Payload, &pr); err != nil {
+			return &permanentError{err: errors.WithStack(err)}
+		}
+		ferr = f.fetchPull(ctx, pr)
+	case "commit":
+		var c commitCommentsPayload
+		if err := json.Unmarshal(p.Payload, &c); err != nil {
+			return &permanentError{err: errors.WithStack(err)}
+		}
+		ferr = f.fetchCommitComments(ctx, c)
+	case "teams":
+		var t teamsPayload
+		if err := json.Unmarshal(p.Payload, &t); err != nil {
+			return &permanentError{err: errors.WithStack(err)}
+		}
+		ferr = f.fetchTeams(ctx, t)
+	case "discussions":
+		var d discussionsPayload
+		if err := json.Unmarshal(p.Payload, &d); err != nil {
+			return &permanentError{err: errors.WithStack(err)}
+		}
+		ferr = f.fetchDiscussions(ctx, d)
+	case "discussion":
+		var d discussionPayload
+		if err := json.Unmarshal(p.Payload, &d); err != nil {
+			return &permanentError{err: errors.WithStack(err)}
+		}
+		ferr = f.fetchDiscussionComments(ctx, d)
+	case "reactions":
+		var r reactionsPayload
+		if err := json.Unmarshal(p.Payload, &r); err != nil {
+			return &permanentError{err: errors.WithStack(err)}
+		}
+		ferr = f.fetchReactions(ctx, r)
 	case "repo":
 		var r repoPayload
 		if err := json.Unmarshal(p.Payload, &r); err != nil {
-			return errors.WithStack(err)
+			return &permanentError{err: errors.WithStack(err)}
 		}
 		ferr = f.fetchRepo(ctx, r)
 	default:
-		return errors.Errorf("don't know what to do with payload of type %v", p.Type)
+		return &permanentError{err: errors.Errorf("don't know what to do with payload of type %v", p.Type)}
 	}
 
-	if rlerr, ok := errors.Cause(ferr).(*github.RateLimitError); ok {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-time.After(time.Until(rlerr.Rate.Reset.Time)):
-			// retry
-			return f.fetch(ctx, b)
-		}
+	if at, ok := retryAt(ferr); ok {
+		// park the payload until the rate limit resets, and keep the worker
+		// available for payloads hitting other rate limits
+		return &deferError{at: at, err: ferr}
+	}
+	if isClientError(ferr) {
+		return &permanentError{err: ferr}
 	}
 	return ferr
 }
 
+// isClientError returns whether err is a GitHub error caused by the request,
+// other than a rate limit. Bad credentials are not the fault of the request.
+func isClientError(err error) bool {
+	if _, ok := retryAt(err); ok {
+		return false
+	}
+	if err, ok := errors.Cause(err).(*github.ErrorResponse); ok && err.Response != nil {
+		status := err.Response.StatusCode
+		return status >= 400 && status < 500 && status != http.StatusUnauthorized
+	}
+	return false
+}
+
+// defaultRetryAfter is how long to wait after a secondary rate limit error
+// that doesn't tell when to retry.
+const defaultRetryAfter = time.Minute
+
+// retryAt returns when the request that failed with err can be retried, if err
+// is a rate limit error.
+func retryAt(err error) (time.Time, bool) {
+	switch err := errors.Cause(err).(type) {
+	case *github.RateLimitError:
+		return err.Rate.Reset.Time.Add(time.Second), true
+	case *github.AbuseRateLimitError:
+		if err.RetryAfter != nil {
+			return time.Now().Add(*err.RetryAfter), true
+		}
+		return time.Now().Add(defaultRetryAfter), true
+	case *github.ErrorResponse:
+		resp := err.Response
+		if resp == nil || (resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests) {
+			return time.Time{}, false
+		}
+		if v := resp.Header.Get("Retry-After"); v != "" {
+			if sec, err := strconv.Atoi(v); err == nil {
+				return time.Now().Add(time.Duration(sec) * time.Second), true
+			}
+			if t, err := http.ParseTime(v); err == nil {
+				return t, true
+			}
+		}
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			if sec, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+				return time.Unix(sec, 0).Add(time.Second), true
+			}
+		}
+		if strings.Contains(strings.ToLower(err.Message), "rate limit") {
+			return time.Now().Add(defaultRetryAfter), true
+		}
+	}
+	return time.Time{}, false
+}
+
 func (f *fetcher) fetchRepo(ctx context.Context, repo repoPayload) error {
+	fullName := strings.Join([]string{repo.Owner, repo.Name}, "/")
+	if firstPage(repo.Page) == 1 {
+		// only list the issues updated since the last complete sync
+		syncedAt, err := f.store.getRepoSyncedAt(ctx, fullName)
+		if err != nil {
+			return err
+		}
+		repo.Since = syncedAt
+
+		// commit comments can't be listed by update time, list them all
+		if err := f.broker.Publish("queue-fetch", priorityBackfill, commitCommentsPayload{Owner: repo.Owner, Name: repo.Name}); err != nil {
+			return err
+		}
+	}
+
 	// TODO: order by reactions?
-	opts := &github.IssueListByRepoOptions{Sort: "updated", State: "all", ListOptions: github.ListOptions{Page: repo.Page, PerPage: 100}}
+	opts := &github.IssueListByRepoOptions{Sort: "updated", Direction: "desc", State: "all", Since: repo.Since, ListOptions: github.ListOptions{Page: repo.Page, PerPage: 100}}
 	start := time.Now()
 	issues, resp, err := f.githubClient.Issues.ListByRepo(ctx, repo.Owner, repo.Name, opts)
 	duration := time.Since(start)
@@ -87,28 +199,120 @@ func (f *fetcher) fetchRepo(ctx context.Context, repo repoPayload) error {
 
 	for i := range issues {
 		issue := issues[i]
-		if ok, err := f.store.issueIsUpToDate(ctx, issue); err != nil {
+		ok, err := f.store.issueIsUpToDate(ctx, issue)
+		if err != nil {
 			return err
-		} else if ok {
+		}
+		// insert it anyway, for its reactions
+		if err := f.store.insertIssue(ctx, issues[i]); err != nil {
+			return err
+		}
+		if ok {
 			continue
 		}
 
-		if err := f.store.insertIssue(ctx, issues[i]); err != nil {
+		if err := f.broker.Publish("queue-fetch", priorityBackfill, issuePayload{URL: issue.GetURL()}); err != nil {
+			return err
+		}
+		if issue.IsPullRequest() {
+			if err := f.broker.Publish("queue-fetch", priorityBackfill, pullPayload{URL: issue.GetURL()}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if firstPage(repo.Page) == 1 && len(issues) > 0 {
+		// issues are sorted by most recently updated first
+		repo.SyncedAt = issues[0].GetUpdatedAt()
+	}
+	if repo.Track {
+		// the repo exists, it is active if issues were updated since the
+		// last sync. since includes the issue updated at the last sync.
+		active := len(issues) > 0 && issues[0].GetUpdatedAt().After(repo.Since)
+		if err := f.scheduler.track(ctx, target{Type: "repo", Name: fullName}, active); err != nil {
 			return err
 		}
+	}
+	if resp.NextPage > opts.ListOptions.Page {
+		return f.broker.Publish("queue-fetch", priorityDefault, repoPayload{Owner: repo.Owner, Name: repo.Name, Page: resp.NextPage, Since: repo.Since, SyncedAt: repo.SyncedAt})
+	}
+	// the sync is complete, next ones can start from there
+	if repo.SyncedAt.IsZero() {
+		return nil
+	}
+	return f.store.setRepoSyncedAt(ctx, fullName, repo.SyncedAt)
+}
 
-		if err := f.broker.Publish("queue-fetch", issuePayload{URL: issue.GetURL()}); err != nil {
+func (f *fetcher) fetchOrg(ctx context.Context, org orgPayload) error {
+	if firstPage(org.Page) == 1 {
+		if err := f.broker.Publish("queue-fetch", priorityBackfill, teamsPayload{Org: org.Login}); err != nil {
+			return err
+		}
+	}
+
+	opts := &github.RepositoryListByOrgOptions{Type: "all", ListOptions: github.ListOptions{Page: org.Page, PerPage: 100}}
+	start := time.Now()
+	repos, resp, err := f.githubClient.Repositories.ListByOrg(ctx, org.Login, opts)
+	duration := time.Since(start)
+	if resp != nil {
+		if err := f.cache.updateRate("github-core-rate", resp.Rate); err != nil {
+			log.Printf("%+v", err)
+		}
+		if err := f.cache.sendToRequestLog(fmt.Sprintf("list %s repos", org.Login), opts.ListOptions, resp, duration); err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for i := range repos {
+		if err := f.broker.Publish("queue-fetch", priorityBackfill, repoPayload{Owner: org.Login, Name: repos[i].GetName()}); err != nil {
+			return err
+		}
+	}
+	if org.Track && len(repos) > 0 {
+		// the org is active if the first page, its most recently created
+		// repos, has repos created or pushed to since it was last fetched
+		t := target{Type: "org", Name: org.Login}
+		fetchedAt, err := f.store.targetFetchedAt(ctx, t)
+		if err != nil {
+			return err
+		}
+		active := false
+		for i := range repos {
+			if repos[i].GetCreatedAt().After(fetchedAt) || repos[i].GetPushedAt().After(fetchedAt) {
+				active = true
+				break
+			}
+		}
+		if err := f.scheduler.track(ctx, t, active); err != nil {
 			return err
 		}
 	}
 
 	if resp.NextPage > opts.ListOptions.Page {
-		return f.broker.Publish("queue-fetch", repoPayload{Owner: repo.Owner, Name: repo.Name, Page: resp.NextPage})
+		return f.broker.Publish("queue-fetch", priorityDefault, orgPayload{Login: org.Login, Page: resp.NextPage})
 	}
 	return nil
 }
 
 func (f *fetcher) fetchUser(ctx context.Context, user userPayload) error {
+	if firstPage(user.Page) == 1 {
+		typ, err := f.ownerType(ctx, user.Login)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case "":
+			// no such account
+			return nil
+		case "Organization":
+			// /{login} was visited, and login turned out to be an org
+			return f.broker.Publish("queue-fetch", priorityInteractive, orgPayload{Login: user.Login, Track: user.Track})
+		}
+	}
+
 	query := fmt.Sprintf(`commenter:"%s"`, user.Login)
 	opts := &github.SearchOptions{Sort: "updated", Order: "desc", ListOptions: github.ListOptions{Page: user.Page, PerPage: 100}}
 	start := time.Now()
@@ -126,41 +330,105 @@ func (f *fetcher) fetchUser(ctx context.Context, user userPayload) error {
 		return errors.WithStack(err)
 	}
 
+	var active bool
 	for i := range result.Issues {
 		issue := result.Issues[i]
-		if ok, err := f.store.issueIsUpToDate(ctx, &issue); err != nil {
+		ok, err := f.store.issueIsUpToDate(ctx, &issue)
+		if err != nil {
 			return err
-		} else if ok {
+		}
+		// insert it anyway, for its reactions
+		if err := f.store.insertIssue(ctx, &issue); err != nil {
+			return err
+		}
+		if ok {
 			continue
 		}
+		active = true
 
-		if err := f.store.insertIssue(ctx, &issue); err != nil {
+		if err := f.broker.Publish("queue-fetch", priorityBackfill, issuePayload{URL: issue.GetURL()}); err != nil {
 			return err
 		}
+		if issue.IsPullRequest() {
+			if err := f.broker.Publish("queue-fetch", priorityBackfill, pullPayload{URL: issue.GetURL()}); err != nil {
+				return err
+			}
+		}
+	}
 
-		if err := f.broker.Publish("queue-fetch", issuePayload{URL: issue.GetURL()}); err != nil {
+	if user.Track && result.GetTotal() > 0 {
+		if err := f.scheduler.track(ctx, target{Type: "user", Name: user.Login}, active); err != nil {
 			return err
 		}
 	}
 
 	if resp.NextPage > opts.ListOptions.Page {
-		return f.broker.Publish("queue-fetch", userPayload{Login: user.Login, Page: resp.NextPage})
+		return f.broker.Publish("queue-fetch", priorityDefault, userPayload{Login: user.Login, Page: resp.NextPage})
 	}
 	return nil
 }
 
+// ownerType returns the type of the GitHub account login, User or
+// Organization, or an empty string if there is no such account.
+func (f *fetcher) ownerType(ctx context.Context, login string) (string, error) {
+	typ, err := f.store.ownerType(ctx, login)
+	if err != nil || typ != "" {
+		return typ, err
+	}
+
+	start := time.Now()
+	user, resp, err := f.githubClient.Users.Get(ctx, login)
+	duration := time.Since(start)
+	if resp != nil {
+		if err := f.cache.updateRate("github-core-rate", resp.Rate); err != nil {
+			log.Printf("%+v", err)
+		}
+		if err := f.cache.sendToRequestLog(fmt.Sprintf("get user %s", login), github.ListOptions{}, resp, duration); err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+	if isGone(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return user.GetType(), f.store.setOwnerType(ctx, login, user.GetType())
+}
+
+// isGone returns whether err is a 404 or 410 response, for deleted issues
+// and comments.
+func isGone(err error) bool {
+	if err, ok := errors.Cause(err).(*github.ErrorResponse); ok && err.Response != nil {
+		return err.Response.StatusCode == http.StatusNotFound || err.Response.StatusCode == http.StatusGone
+	}
+	return false
+}
+
 var issueURLRegexp = regexp.MustCompile(`^https://api\.github\.com/repos/([\w-]+)/([\w\.-]+)/issues/(\d+)$`)
 
-func (f *fetcher) fetchIssue(ctx context.Context, issue issuePayload) error {
-	match := issueURLRegexp.FindStringSubmatch(issue.URL)
+// parseIssueURL returns the owner, repo and number of the issue at url.
+func parseIssueURL(url string) (string, string, int, error) {
+	match := issueURLRegexp.FindStringSubmatch(url)
 	if len(match) < 4 {
-		return errors.Errorf("couldn't match %s", issue.URL)
+		return "", "", 0, &permanentError{err: errors.Errorf("couldn't match %s", url)}
 	}
-	owner := match[1]
-	repo := match[2]
 	number, err := strconv.Atoi(match[3])
 	if err != nil {
-		return errors.WithStack(err)
+		return "", "", 0, &permanentError{err: errors.WithStack(err)}
+	}
+	return match[1], match[2], number, nil
+}
+
+func (f *fetcher) fetchIssue(ctx context.Context, issue issuePayload) error {
+	owner, repo, number, err := parseIssueURL(issue.URL)
+	if err != nil {
+		return err
+	}
+
+	if firstPage(issue.Page) == 1 {
+		if issue.StartedAt, err = f.store.now(ctx); err != nil {
+			return err
+		}
 	}
 
 	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{Page: issue.Page, PerPage: 100}}
@@ -175,7 +443,9 @@ func (f *fetcher) fetchIssue(ctx context.Context, issue issuePayload) error {
 			log.Printf("%+v", err)
 		}
 	}
-	if err != nil {
+	if isGone(err) {
+		return f.store.deleteIssue(ctx, issue.URL)
+	} else if err != nil {
 		return errors.WithStack(err)
 	}
 
@@ -186,7 +456,311 @@ func (f *fetcher) fetchIssue(ctx context.Context, issue issuePayload) error {
 	}
 
 	if resp.NextPage > opts.ListOptions.Page {
-		return f.broker.Publish("queue-fetch", issuePayload{URL: issue.URL, Page: resp.NextPage})
+		return f.broker.Publish("queue-fetch", priorityBackfill, issuePayload{URL: issue.URL, Page: resp.NextPage, StartedAt: issue.StartedAt})
+	}
+	// all the comments were listed
+	return f.store.deleteUnseenComments(ctx, kindIssue, issue.URL, issue.StartedAt)
+}
+
+func (f *fetcher) fetchPull(ctx context.Context, pull pullPayload) error {
+	owner, repo, number, err := parseIssueURL(pull.URL)
+	if err != nil {
+		return err
+	}
+
+	if firstPage(pull.Page) == 1 {
+		if pull.StartedAt, err = f.store.now(ctx); err != nil {
+			return err
+		}
+	}
+
+	opts := &github.PullRequestListCommentsOptions{ListOptions: github.ListOptions{Page: pull.Page, PerPage: 100}}
+	start := time.Now()
+	comments, resp, err := f.githubClient.PullRequests.ListComments(ctx, owner, repo, number, opts)
+	duration := time.Since(start)
+	if resp != nil {
+		if err := f.cache.updateRate("github-core-rate", resp.Rate); err != nil {
+			log.Printf("%+v", err)
+		}
+		if err := f.cache.sendToRequestLog(fmt.Sprintf("list %s/%s#%d review comments", owner, repo, number), opts.ListOptions, resp, duration); err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+	if isGone(err) {
+		// fetchIssue deletes the issue of the pull request
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for i := range comments {
+		if err := f.store.insertReviewComment(ctx, comments[i], strings.Join([]string{owner, repo}, "/")); err != nil {
+			return err
+		}
+	}
+
+	if resp.NextPage > opts.ListOptions.Page {
+		return f.broker.Publish("queue-fetch", priorityBackfill, pullPayload{URL: pull.URL, Page: resp.NextPage, StartedAt: pull.StartedAt})
+	}
+	// all the review comments were listed
+	pullURL := strings.Replace(pull.URL, "/issues/", "/pulls/", 1)
+	return f.store.deleteUnseenComments(ctx, kindReview, pullURL, pull.StartedAt)
+}
+
+func (f *fetcher) fetchCommitComments(ctx context.Context, commit commitCommentsPayload) error {
+	opts := &github.ListOptions{Page: commit.Page, PerPage: 100}
+	start := time.Now()
+	comments, resp, err := f.githubClient.Repositories.ListComments(ctx, commit.Owner, commit.Name, opts)
+	duration := time.Since(start)
+	if resp != nil {
+		if err := f.cache.updateRate("github-core-rate", resp.Rate); err != nil {
+			log.Printf("%+v", err)
+		}
+		if err := f.cache.sendToRequestLog(fmt.Sprintf("list %s/%s commit comments", commit.Owner, commit.Name), *opts, resp, duration); err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for i := range comments {
+		if err := f.store.insertCommitComment(ctx, comments[i], strings.Join([]string{commit.Owner, commit.Name}, "/")); err != nil {
+			return err
+		}
+	}
+
+	if resp.NextPage > opts.Page {
+		return f.broker.Publish("queue-fetch", priorityBackfill, commitCommentsPayload{Owner: commit.Owner, Name: commit.Name, Page: resp.NextPage})
+	}
+	return nil
+}
+
+// The vendored go-github doesn't cover teams and their discussions, they are
+// requested with getTeamAPI.
+type (
+	githubTeam struct {
+		ID   int64  `json:"id"`
+		Slug string `json:"slug"`
+	}
+	githubTeamDiscussion struct {
+		Number        int `json:"number"`
+		CommentsCount int `json:"comments_count"`
+	}
+	// githubTeamDiscussionComment has no id, and its user is its author.
+	githubTeamDiscussionComment struct {
+		Author    *github.User      `json:"author"`
+		Body      string            `json:"body"`
+		HTMLURL   string            `json:"html_url"`
+		URL       string            `json:"url"`
+		CreatedAt time.Time         `json:"created_at"`
+		UpdatedAt time.Time         `json:"updated_at"`
+		Reactions *github.Reactions `json:"reactions"`
+	}
+)
+
+// issueComment returns c as the issue comment it is stored as. Its id is
+// derived from its URL, which is unique.
+func (c *githubTeamDiscussionComment) issueComment() *github.IssueComment {
+	h := fnv.New64a()
+	h.Write([]byte(c.URL))
+	return &github.IssueComment{
+		ID:        github.Int64(int64(h.Sum64() >> 1)),
+		Body:      github.String(c.Body),
+		User:      c.Author,
+		Reactions: c.Reactions,
+		HTMLURL:   github.String(c.HTMLURL),
+		URL:       github.String(c.URL),
+		CreatedAt: &c.CreatedAt,
+		UpdatedAt: &c.UpdatedAt,
+	}
+}
+
+// mediaTypeTeamDiscussions enables the team discussions API, and the
+// reactions of their comments.
+const mediaTypeTeamDiscussions = "application/vnd.github.echo-preview+json, application/vnd.github.squirrel-girl-preview"
+
+// getTeamAPI gets the page opts of the team API resource at url into v. name
+// describes the request in the request log.
+func (f *fetcher) getTeamAPI(ctx context.Context, url string, opts github.ListOptions, v interface{}, name string) (*github.Response, error) {
+	if opts.PerPage != 0 {
+		url = fmt.Sprintf("%s?page=%d&per_page=%d", url, opts.Page, opts.PerPage)
+	}
+	req, err := f.githubClient.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Accept", mediaTypeTeamDiscussions)
+
+	start := time.Now()
+	resp, err := f.githubClient.Do(ctx, req, v)
+	duration := time.Since(start)
+	if resp != nil {
+		if err := f.cache.updateRate("github-core-rate", resp.Rate); err != nil {
+			log.Printf("%+v", err)
+		}
+		if err := f.cache.sendToRequestLog(name, opts, resp, duration); err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+	return resp, errors.WithStack(err)
+}
+
+// isHidden returns whether err is GitHub refusing to show a resource, like
+// the teams of an org the authenticated user is not a member of.
+func isHidden(err error) bool {
+	if _, ok := retryAt(err); ok {
+		return false
+	}
+	if err, ok := errors.Cause(err).(*github.ErrorResponse); ok && err.Response != nil {
+		return err.Response.StatusCode == http.StatusForbidden || isGone(err)
+	}
+	return false
+}
+
+func (f *fetcher) fetchTeams(ctx context.Context, t teamsPayload) error {
+	opts := github.ListOptions{Page: t.Page, PerPage: 100}
+	var teams []githubTeam
+	resp, err := f.getTeamAPI(ctx, fmt.Sprintf("orgs/%s/teams", t.Org), opts, &teams, fmt.Sprintf("list %s teams", t.Org))
+	if isHidden(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for i := range teams {
+		if err := f.broker.Publish("queue-fetch", priorityBackfill, discussionsPayload{Org: t.Org, TeamID: teams[i].ID}); err != nil {
+			return err
+		}
+	}
+
+	if resp.NextPage > opts.Page {
+		return f.broker.Publish("queue-fetch", priorityBackfill, teamsPayload{Org: t.Org, Page: resp.NextPage})
+	}
+	return nil
+}
+
+func (f *fetcher) fetchDiscussions(ctx context.Context, d discussionsPayload) error {
+	opts := github.ListOptions{Page: d.Page, PerPage: 100}
+	var discussions []githubTeamDiscussion
+	resp, err := f.getTeamAPI(ctx, fmt.Sprintf("teams/%d/discussions", d.TeamID), opts, &discussions, fmt.Sprintf("list %s team %d discussions", d.Org, d.TeamID))
+	if isHidden(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for i := range discussions {
+		if discussions[i].CommentsCount == 0 {
+			continue
+		}
+		if err := f.broker.Publish("queue-fetch", priorityBackfill, discussionPayload{Org: d.Org, TeamID: d.TeamID, Number: discussions[i].Number}); err != nil {
+			return err
+		}
+	}
+
+	if resp.NextPage > opts.Page {
+		return f.broker.Publish("queue-fetch", priorityBackfill, discussionsPayload{Org: d.Org, TeamID: d.TeamID, Page: resp.NextPage})
+	}
+	return nil
+}
+
+func (f *fetcher) fetchDiscussionComments(ctx context.Context, d discussionPayload) error {
+	opts := github.ListOptions{Page: d.Page, PerPage: 100}
+	var comments []githubTeamDiscussionComment
+	resp, err := f.getTeamAPI(ctx, fmt.Sprintf("teams/%d/discussions/%d/comments", d.TeamID, d.Number), opts, &comments, fmt.Sprintf("list %s team %d discussion %d comments", d.Org, d.TeamID, d.Number))
+	if isHidden(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for i := range comments {
+		if err := f.store.insertDiscussionComment(ctx, comments[i].issueComment(), d.Org); err != nil {
+			return err
+		}
+	}
+
+	if resp.NextPage > opts.Page {
+		return f.broker.Publish("queue-fetch", priorityBackfill, discussionPayload{Org: d.Org, TeamID: d.TeamID, Number: d.Number, Page: resp.NextPage})
 	}
 	return nil
 }
+
+func (f *fetcher) fetchReactions(ctx context.Context, r reactionsPayload) error {
+	if r.Kind == kindDiscussion {
+		return f.fetchDiscussionReactions(ctx, r)
+	}
+	split := strings.SplitN(r.Repo, "/", 2)
+	if len(split) != 2 {
+		return &permanentError{err: errors.Errorf("couldn't split repo %s", r.Repo)}
+	}
+	owner, repo := split[0], split[1]
+
+	var (
+		resp   *github.Response
+		err    error
+		insert func() error
+	)
+	start := time.Now()
+	switch r.Kind {
+	case kindIssue:
+		var comment *github.IssueComment
+		comment, resp, err = f.githubClient.Issues.GetComment(ctx, owner, repo, int(r.ID))
+		insert = func() error { return f.store.insertComment(ctx, comment, r.Repo) }
+	case kindReview:
+		var comment *github.PullRequestComment
+		comment, resp, err = f.githubClient.PullRequests.GetComment(ctx, owner, repo, int(r.ID))
+		insert = func() error { return f.store.insertReviewComment(ctx, comment, r.Repo) }
+	case kindCommit:
+		var comment *github.RepositoryComment
+		comment, resp, err = f.githubClient.Repositories.GetComment(ctx, owner, repo, r.ID)
+		insert = func() error { return f.store.insertCommitComment(ctx, comment, r.Repo) }
+	case kindBody:
+		_, _, number, perr := parseIssueURL(r.URL)
+		if perr != nil {
+			return perr
+		}
+		var issue *github.Issue
+		issue, resp, err = f.githubClient.Issues.Get(ctx, owner, repo, number)
+		insert = func() error { return f.store.insertIssue(ctx, issue) }
+	default:
+		return &permanentError{err: errors.Errorf("don't know how to refresh the reactions of kind %s", r.Kind)}
+	}
+	duration := time.Since(start)
+	if resp != nil {
+		if err := f.cache.updateRate("github-core-rate", resp.Rate); err != nil {
+			log.Printf("%+v", err)
+		}
+		if err := f.cache.sendToRequestLog(fmt.Sprintf("get %s %s %d", r.Repo, r.Kind, r.ID), github.ListOptions{}, resp, duration); err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+	if isGone(err) {
+		return f.store.deleteComment(ctx, r.Kind, r.ID)
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := insert(); err != nil {
+		return err
+	}
+	return f.store.setRefreshedAt(ctx, r.Kind, r.ID)
+}
+
+// fetchDiscussionReactions is fetchReactions for team discussion comments,
+// which are fetched by URL.
+func (f *fetcher) fetchDiscussionReactions(ctx context.Context, r reactionsPayload) error {
+	var comment githubTeamDiscussionComment
+	_, err := f.getTeamAPI(ctx, r.URL, github.ListOptions{}, &comment, fmt.Sprintf("get %s %s %d", r.Repo, r.Kind, r.ID))
+	if isGone(err) {
+		return f.store.deleteComment(ctx, r.Kind, r.ID)
+	} else if err != nil {
+		return err
+	}
+
+	if err := f.store.insertDiscussionComment(ctx, comment.issueComment(), r.Repo); err != nil {
+		return err
+	}
+	return f.store.setRefreshedAt(ctx, r.Kind, r.ID)
+}
@@ -13,6 +13,13 @@ import (
 
 func main() {
 	log.SetFlags(log.Lshortfile)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(context.Background(), mustConnectDB(), os.Args[2:]); err != nil {
+			log.Fatalf("%+v", err)
+		}
+		return
+	}
+
 	app := newApp()
 	g, ctx := errgroup.WithContext(context.Background())
 
@@ -29,7 +36,12 @@ func main() {
 	})
 
 	g.Go(server(ctx, app.port, app.mux))
-	g.Go(worker(ctx, app.receiver, "queue-fetch", app.fetcher.fetch))
+	for i := 0; i < app.concurrency; i++ {
+		g.Go(worker(ctx, app.receiver, "queue-fetch", app.fetcher.fetch))
+	}
+	g.Go(sweeper(ctx, app.receiver, "queue-fetch", app.visibilityTimeout))
+	g.Go(func() error { return app.scheduler.Run(ctx) })
+	g.Go(func() error { return app.transport.Prune(ctx, app.httpCacheTTL) })
 
 	if err := g.Wait(); err != nil {
 		log.Fatalf("%+v", err)
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// migration is a step of the schema.
+type migration struct {
+	name     string
+	up, down string
+}
+
+// migrations are the steps of the schema, in order. The schema is at version
+// n when the first n migrations are applied. Released migrations must not be
+// edited, append new ones instead.
+//
+// The objects are created if they don't exist, so that databases created
+// from the former schema.sql can be migrated too.
+var migrations = []migration{
+	{
+		name: "create issues and comments",
+		up: `create table if not exists issues(j jsonb not null, check(j?'id'));
+create unique index if not exists issues_id_idx on issues(((j->>'id')::int));
+
+create table if not exists comments(j jsonb not null, repo text not null, check(j?'id'));
+create unique index if not exists comments_id_idx on comments(((j->>'id')::int));
+create index if not exists comments_reactions_total_count_idx on comments (((j#>>'{reactions,total_count}')::int));
+create index if not exists comments_user_login_idx on comments ((j#>>'{user,login}'));
+create index if not exists comments_issue_url_idx on comments ((j->>'issue_url'));
+create index if not exists comments_repo on comments (repo);`,
+		down: `drop table comments;
+drop table issues;`,
+	},
+	{
+		name: "create jobs for BROKER_BACKEND=postgres",
+		up: `create table if not exists jobs(
+    id bigserial primary key,
+    queue text not null,
+    lane text not null,
+    list text not null,
+    body bytea not null,
+    run_at timestamptz,
+    claimed_at timestamptz
+);
+create index if not exists jobs_list_idx on jobs (queue, list, id);
+create index if not exists jobs_body_idx on jobs (queue, list, md5(body));
+create index if not exists jobs_run_at_idx on jobs (run_at) where run_at is not null;
+create table if not exists job_keys(queue text not null, key text not null, expires_at timestamptz not null, primary key (queue, key));`,
+		down: `drop table job_keys;
+drop table jobs;`,
+	},
+	{
+		name: "create http_cache",
+		up:   `create table if not exists http_cache(key text primary key, etag text not null, last_modified text not null, header jsonb not null, body bytea not null);`,
+		down: `drop table http_cache;`,
+	},
+	{
+		name: "create repos",
+		up:   `create table if not exists repos(repo text primary key, synced_at timestamptz not null);`,
+		down: `drop table repos;`,
+	},
+	{
+		name: "rank review comments and issue bodies",
+		up: `alter table comments add column if not exists kind text not null default 'issue';
+drop index if exists comments_id_idx;
+create unique index comments_id_idx on comments(kind, ((j->>'id')::int));
+create index if not exists issues_reactions_total_count_idx on issues (((j#>>'{reactions,total_count}')::int));
+create index if not exists issues_user_login_idx on issues ((j#>>'{user,login}'));
+create index if not exists issues_repo_idx on issues ((regexp_replace(j->>'repository_url', '^.*/repos/', '')));`,
+		down: `drop index issues_repo_idx;
+drop index issues_user_login_idx;
+drop index issues_reactions_total_count_idx;
+delete from comments where kind <> 'issue';
+drop index comments_id_idx;
+create unique index comments_id_idx on comments(((j->>'id')::int));
+alter table comments drop column kind;`,
+	},
+	{
+		name: "index the owners of repos",
+		up:   `create index if not exists comments_owner_idx on comments (split_part(repo, '/', 1));`,
+		down: `drop index comments_owner_idx;`,
+	},
+	{
+		name: "index reactions by type",
+		up: `create index if not exists issues_reactions_plus_one_idx on issues (((j#>>'{reactions,+1}')::int));
+create index if not exists issues_reactions_minus_one_idx on issues (((j#>>'{reactions,-1}')::int));
+create index if not exists issues_reactions_laugh_idx on issues (((j#>>'{reactions,laugh}')::int));
+create index if not exists issues_reactions_confused_idx on issues (((j#>>'{reactions,confused}')::int));
+create index if not exists issues_reactions_heart_idx on issues (((j#>>'{reactions,heart}')::int));
+create index if not exists issues_reactions_hooray_idx on issues (((j#>>'{reactions,hooray}')::int));
+create index if not exists issues_reactions_score_idx on issues ((coalesce((j#>>'{reactions,+1}')::int, 0) - coalesce((j#>>'{reactions,-1}')::int, 0)));
+create index if not exists comments_reactions_plus_one_idx on comments (((j#>>'{reactions,+1}')::int));
+create index if not exists comments_reactions_minus_one_idx on comments (((j#>>'{reactions,-1}')::int));
+create index if not exists comments_reactions_laugh_idx on comments (((j#>>'{reactions,laugh}')::int));
+create index if not exists comments_reactions_confused_idx on comments (((j#>>'{reactions,confused}')::int));
+create index if not exists comments_reactions_heart_idx on comments (((j#>>'{reactions,heart}')::int));
+create index if not exists comments_reactions_hooray_idx on comments (((j#>>'{reactions,hooray}')::int));
+create index if not exists comments_reactions_score_idx on comments ((coalesce((j#>>'{reactions,+1}')::int, 0) - coalesce((j#>>'{reactions,-1}')::int, 0)));`,
+		down: `drop index issues_reactions_plus_one_idx, issues_reactions_minus_one_idx, issues_reactions_laugh_idx,
+    issues_reactions_confused_idx, issues_reactions_heart_idx, issues_reactions_hooray_idx, issues_reactions_score_idx;
+drop index comments_reactions_plus_one_idx, comments_reactions_minus_one_idx, comments_reactions_laugh_idx,
+    comments_reactions_confused_idx, comments_reactions_heart_idx, comments_reactions_hooray_idx, comments_reactions_score_idx;`,
+	},
+	{
+		name: "index bodies for full-text search",
+		up: `create index if not exists issues_body_search_idx on issues using gin (to_tsvector('english', coalesce(j->>'body', '')));
+create index if not exists comments_body_search_idx on comments using gin (to_tsvector('english', coalesce(j->>'body', '')));`,
+		down: `drop index issues_body_search_idx, comments_body_search_idx;`,
+	},
+	{
+		name: "index created_at",
+		// casts from text to timestamptz are only stable, they can't be
+		// indexed
+		up: `create or replace function jsonb_created_at(j jsonb) returns timestamptz as $$
+    select (j->>'created_at')::timestamptz
+$$ language sql immutable;
+create index if not exists issues_created_at_idx on issues (jsonb_created_at(j));
+create index if not exists comments_created_at_idx on comments (jsonb_created_at(j));`,
+		down: `drop index issues_created_at_idx, comments_created_at_idx;
+drop function jsonb_created_at(jsonb);`,
+	},
+	{
+		name: "create reaction_snapshots",
+		// appended to when the reactions of a comment change, by kind and id
+		// of the comment
+		up: `create table if not exists reaction_snapshots(
+    kind text not null,
+    id bigint not null,
+    taken_at timestamptz not null default now(),
+    total_count int not null,
+    reactions jsonb not null
+);
+create index if not exists reaction_snapshots_id_idx on reaction_snapshots (kind, id, taken_at);
+create index if not exists reaction_snapshots_taken_at_idx on reaction_snapshots (taken_at);`,
+		down: `drop table reaction_snapshots;`,
+	},
+	{
+		name: "create tracked_targets",
+		up: `create table if not exists tracked_targets(
+    type text not null,
+    name text not null,
+    interval_seconds bigint not null,
+    next_run_at timestamptz not null,
+    primary key (type, name)
+);
+create index if not exists tracked_targets_next_run_at_idx on tracked_targets (type, next_run_at);`,
+		down: `drop table tracked_targets;`,
+	},
+	{
+		name: "create reaction_refreshes",
+		up: `create table if not exists reaction_refreshes(
+    kind text not null,
+    id bigint not null,
+    refreshed_at timestamptz not null,
+    primary key (kind, id)
+);`,
+		down: `drop table reaction_refreshes;`,
+	},
+	{
+		name: "mark deleted issues and comments",
+		// deleted_at is set on issues when GitHub responds 404 or 410, and
+		// on comments when they are no longer listed since seen_at
+		up: `alter table issues add column if not exists deleted_at timestamptz;
+alter table comments add column if not exists seen_at timestamptz not null default now();
+alter table comments add column if not exists deleted_at timestamptz;
+create index if not exists issues_url_idx on issues ((j->>'url'));
+create index if not exists comments_pull_request_url_idx on comments ((j->>'pull_request_url'));`,
+		down: `drop index issues_url_idx, comments_pull_request_url_idx;
+alter table comments drop column deleted_at;
+alter table comments drop column seen_at;
+alter table issues drop column deleted_at;`,
+	},
+	{
+		name: "key jobs",
+		// so that Push can move a pending job to a lane of higher priority
+		up: `alter table jobs add column if not exists key text;
+create index if not exists jobs_key_idx on jobs (queue, key, list);`,
+		down: `drop index jobs_key_idx;
+alter table jobs drop column key;`,
+	},
+	{
+		name: "index ids as bigint",
+		// GitHub ids are above 2^31
+		up: `drop index if exists issues_id_idx;
+create unique index issues_id_idx on issues(((j->>'id')::bigint));
+drop index if exists comments_id_idx;
+create unique index comments_id_idx on comments(kind, ((j->>'id')::bigint));`,
+		down: `drop index issues_id_idx;
+create unique index issues_id_idx on issues(((j->>'id')::int));
+drop index comments_id_idx;
+create unique index comments_id_idx on comments(kind, ((j->>'id')::int));`,
+	},
+	{
+		name: "expire http_cache",
+		// used_at is set when a response is stored or revalidated
+		up: `alter table http_cache add column if not exists used_at timestamptz not null default now();
+create index if not exists http_cache_used_at_idx on http_cache (used_at);`,
+		down: `alter table http_cache drop column used_at;`,
+	},
+	{
+		name: "expire tracked_targets",
+		up: `alter table tracked_targets add column if not exists visited_at timestamptz not null default now();
+create index if not exists tracked_targets_visited_at_idx on tracked_targets (visited_at);`,
+		down: `alter table tracked_targets drop column visited_at;`,
+	},
+	{
+		name: "create owners",
+		// the type of GitHub accounts, User or Organization, by lowercase
+		// login
+		up:   `create table if not exists owners(login text primary key, type text not null);`,
+		down: `drop table owners;`,
+	},
+	{
+		name: "track fetched_at",
+		// fetched_at is set when a fetch tracks the target
+		up:   `alter table tracked_targets add column if not exists fetched_at timestamptz;`,
+		down: `alter table tracked_targets drop column fetched_at;`,
+	},
+}
+
+const schemaMigrationsSQL = `create table if not exists schema_migrations(
+    version int primary key,
+    applied_at timestamptz not null default now()
+)`
+
+// schemaVersion returns the version of the schema of db.
+func schemaVersion(ctx context.Context, db *sqlx.DB) (int, error) {
+	if _, err := db.ExecContext(ctx, schemaMigrationsSQL); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	var version int
+	err := db.GetContext(ctx, &version, `select coalesce(max(version), 0) from schema_migrations`)
+	return version, errors.WithStack(err)
+}
+
+// migrateUp applies the migrations that are not applied yet, each in its
+// own transaction.
+func migrateUp(ctx context.Context, db *sqlx.DB) error {
+	if _, err := db.ExecContext(ctx, schemaMigrationsSQL); err != nil {
+		return errors.WithStack(err)
+	}
+	for {
+		done, err := migrateStep(ctx, db, func(version int) (int, string, bool) {
+			if version >= len(migrations) {
+				return 0, "", false
+			}
+			return version + 1, migrations[version].up, true
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateDown reverts the last applied migration.
+func migrateDown(ctx context.Context, db *sqlx.DB) error {
+	if _, err := db.ExecContext(ctx, schemaMigrationsSQL); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := migrateStep(ctx, db, func(version int) (int, string, bool) {
+		if version == 0 || version > len(migrations) {
+			return 0, "", false
+		}
+		return version - 1, migrations[version-1].down, true
+	})
+	return err
+}
+
+// migrateStep runs the statements that next returns for the current
+// version, and sets the version it returns, unless it returns false. Other
+// migrations wait for the lock on schema_migrations.
+func migrateStep(ctx context.Context, db *sqlx.DB, next func(version int) (int, string, bool)) (bool, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `lock table schema_migrations in exclusive mode`); err != nil {
+		return false, errors.WithStack(err)
+	}
+	var version int
+	if err := tx.GetContext(ctx, &version, `select coalesce(max(version), 0) from schema_migrations`); err != nil {
+		return false, errors.WithStack(err)
+	}
+	to, statements, ok := next(version)
+	if !ok {
+		return true, nil
+	}
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		return false, errors.Wrapf(err, "couldn't migrate from version %d to %d", version, to)
+	}
+	if to > version {
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations(version) values($1)`, to)
+	} else {
+		_, err = tx.ExecContext(ctx, `delete from schema_migrations where version > $1`, to)
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, errors.WithStack(err)
+	}
+	return false, nil
+}
+
+// migrate runs the migrate subcommand: up (the default) applies all the
+// migrations, down reverts the last one, and version prints the version of
+// the schema.
+func migrate(ctx context.Context, db *sqlx.DB, args []string) error {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "up":
+		if err := migrateUp(ctx, db); err != nil {
+			return err
+		}
+	case "down":
+		if err := migrateDown(ctx, db); err != nil {
+			return err
+		}
+	case "version":
+	default:
+		return errors.Errorf("unknown migrate command %q, expected up, down or version", cmd)
+	}
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	name := "empty"
+	if version > 0 && version <= len(migrations) {
+		name = migrations[version-1].name
+	}
+	fmt.Printf("schema at version %d/%d (%s)\n", version, len(migrations), name)
+	return nil
+}
+
+// checkSchema returns an error when the schema of db is behind the
+// migrations.
+func checkSchema(ctx context.Context, db *sqlx.DB) error {
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if version < len(migrations) {
+		return errors.Errorf("schema at version %d, expected %d: run migrate", version, len(migrations))
+	}
+	return nil
+}
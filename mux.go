@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/google/go-github/github"
@@ -14,12 +16,15 @@ import (
 	"github.com/pkg/errors"
 )
 
-func newMux(broker *broker, cache *cache, store *store, template *template.Template) *http.ServeMux {
+func newMux(broker *broker, cache *cache, scheduler *scheduler, store *store, template *template.Template) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/favicon.ico", http.NotFoundHandler())
-	mux.Handle("/_status", statusHandler(cache, template))
+	mux.Handle("/_status", statusHandler(broker, cache, template))
+	mux.Handle("/_status/requeue-dead", requeueDeadHandler(broker))
+	mux.Handle("/_trending", trendingHandler(store, template))
 	mux.Handle("/_ws", wsHandler(cache))
-	mux.Handle("/", rootHandler(broker, store, template))
+	mux.Handle("/api/v1/", apiHandler(broker, cache, scheduler, store))
+	mux.Handle("/", rootHandler(broker, scheduler, store, template))
 	return mux
 }
 
@@ -34,50 +39,14 @@ func handleError(h handlerFunc) http.HandlerFunc {
 	}
 }
 
-func statusHandler(cache *cache, template *template.Template) http.HandlerFunc {
+func statusHandler(broker *broker, cache *cache, template *template.Template) http.HandlerFunc {
 	return handleError(func(w http.ResponseWriter, r *http.Request) error {
 		var data struct {
-			QueueFetchCount, QueueFetchProcessingCount int
-			CoreRate, SearchRate                       *github.Rate
-			Requests                                   []githubRequest
-		}
-
-		b, err := cache.Get("queue-fetch-count")
-		if err != nil {
-			log.Print(err)
-		} else if b != nil {
-			data.QueueFetchCount, _ = strconv.Atoi(string(b))
-		}
-
-		b, err = cache.Get("queue-fetch-processing-count")
-		if err != nil {
-			log.Print(err)
-		} else if b != nil {
-			data.QueueFetchProcessingCount, _ = strconv.Atoi(string(b))
-		}
-
-		b, err = cache.Get("github-search-rate")
-		if err != nil {
-			log.Print(err)
-		} else if b != nil {
-			var searchRate github.Rate
-			if err := json.Unmarshal(b, &searchRate); err != nil {
-				log.Print(err)
-			} else {
-				data.SearchRate = &searchRate
-			}
-		}
-		b, err = cache.Get("github-core-rate")
-		if err != nil {
-			log.Print(err)
-		} else if b != nil {
-			var coreRate github.Rate
-			if err := json.Unmarshal(b, &coreRate); err != nil {
-				log.Print(err)
-			} else {
-				data.CoreRate = &coreRate
-			}
+			status
+			Requests []githubRequest
+			Dead     []payload
 		}
+		data.status = getStatus(broker, cache)
 
 		ss, err := cache.LRange("github-requests", 0, 1000)
 		if err != nil {
@@ -91,11 +60,58 @@ func statusHandler(cache *cache, template *template.Template) http.HandlerFunc {
 			data.Requests = append(data.Requests, r)
 		}
 
+		data.Dead, err = broker.Dead("queue-fetch", 100)
+		if err != nil {
+			log.Print(err)
+		}
+
 		return errors.WithStack(
 			template.ExecuteTemplate(w, "status.html", data))
 	})
 }
 
+// status holds the counts of the queues and the GitHub rate limits. Errors
+// are logged, and leave the fields empty.
+type status struct {
+	Counts     map[string]int64 `json:"counts"`
+	CoreRate   *github.Rate     `json:"core_rate"`
+	SearchRate *github.Rate     `json:"search_rate"`
+}
+
+func getStatus(broker *broker, cache *cache) status {
+	var s status
+	counts, err := broker.Counts("queue-fetch")
+	if err != nil {
+		log.Print(err)
+	}
+	s.Counts = counts
+
+	if s.SearchRate, err = cache.rate("github-search-rate"); err != nil {
+		log.Print(err)
+	}
+	if s.CoreRate, err = cache.rate("github-core-rate"); err != nil {
+		log.Print(err)
+	}
+	return s
+}
+
+func requeueDeadHandler(broker *broker) http.HandlerFunc {
+	return handleError(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return nil
+		}
+		n, err := broker.RequeueDead("queue-fetch")
+		log.Printf("requeued %d dead payloads", n)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/_status", http.StatusSeeOther)
+		return nil
+	})
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -122,8 +138,7 @@ func wsHandler(cache *cache) http.HandlerFunc {
 			}
 		}()
 
-		// TODO: abstract redis pubsub in cache
-		pubsub := cache.redis.PSubscribe("github-requests", "github-*-rate", "queue-*-count")
+		pubsub := cache.PSubscribe("github-requests", "github-*-rate", "queue-*-count")
 		defer pubsub.Close()
 
 		pubsubc := pubsub.Channel()
@@ -163,50 +178,144 @@ func wsHandler(cache *cache) http.HandlerFunc {
 	})
 }
 
-func rootHandler(broker *broker, store *store, template *template.Template) http.HandlerFunc {
+func rootHandler(broker *broker, scheduler *scheduler, store *store, template *template.Template) http.HandlerFunc {
 	return handleError(func(w http.ResponseWriter, r *http.Request) error {
 		start := time.Now()
-		var (
-			comments []comment
-			err      error
-		)
+		filter, err := parseFilterQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
 
 		split := strings.Split(r.URL.Path, "/")
-		ctx := r.Context()
 		switch {
+		case len(split) >= 3 && split[1] == "orgs" && split[2] != "":
+			// the former page of orgs, no user can be named orgs
+			u := *r.URL
+			u.Path = "/" + split[2]
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return nil
 		case len(split) >= 3 && split[2] != "":
-			owner := split[1]
-			repo := split[2]
-			comments, err = store.getCommentsForRepo(ctx, owner, repo)
-			if err != nil {
-				return err
-			}
-
-			if err := broker.Publish("queue-fetch", repoPayload{Owner: owner, Name: repo}); err != nil {
-				return err
-			}
+			filter.Repo = strings.Join([]string{split[1], split[2]}, "/")
 		case len(split) >= 2 && split[1] != "":
-			user := split[1]
-			comments, err = store.getCommentsForUser(ctx, user)
+			// logins are users until the fetch of the user finds an org
+			typ, err := store.ownerType(r.Context(), split[1])
 			if err != nil {
 				return err
 			}
-			if err := broker.Publish("queue-fetch", userPayload{Login: user}); err != nil {
-				return err
-			}
-		default:
-			comments, err = store.getComments(ctx)
-			if err != nil {
-				return err
+			if typ == "Organization" {
+				filter.Org = split[1]
+			} else {
+				filter.User = split[1]
 			}
 		}
+		if err := publishFilter(r.Context(), broker, scheduler, filter); err != nil {
+			return err
+		}
+
+		page, err := store.getComments(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		switch r.URL.Query().Get("feed") {
+		case "atom":
+			return writeAtom(w, r, filter, page.Comments)
+		case "rss":
+			return writeRSS(w, r, filter, page.Comments)
+		}
+
+		if err := store.loadSparklines(r.Context(), page.Comments); err != nil {
+			return err
+		}
+
+		data := struct {
+			Duration   time.Duration
+			Comments   []comment
+			Next, Prev *cursor
+			Filter     commentFilter
+		}{Comments: page.Comments, Next: page.Next, Prev: page.Prev, Duration: time.Since(start), Filter: filter}
+
+		return errors.WithStack(
+			template.ExecuteTemplate(w, "index.html", data))
+	})
+}
+
+func trendingHandler(store *store, template *template.Template) http.HandlerFunc {
+	return handleError(func(w http.ResponseWriter, r *http.Request) error {
+		start := time.Now()
+		window := r.URL.Query().Get("window")
+		if _, ok := windows[window]; !ok {
+			window = "7d"
+		}
+		comments, err := store.getTrending(r.Context(), time.Now().Add(-windows[window]))
+		if err != nil {
+			return err
+		}
+		if err := store.loadSparklines(r.Context(), comments); err != nil {
+			return err
+		}
 
 		data := struct {
 			Duration time.Duration
 			Comments []comment
-		}{Comments: comments, Duration: time.Since(start)}
+			Window   string
+		}{Comments: comments, Duration: time.Since(start), Window: window}
 
 		return errors.WithStack(
-			template.ExecuteTemplate(w, "index.html", data))
+			template.ExecuteTemplate(w, "trending.html", data))
 	})
 }
+
+// parseFilterQuery returns the filter set by the query parameters of a page.
+func parseFilterQuery(q url.Values) (commentFilter, error) {
+	filter := commentFilter{Show: q.Get("show"), Sort: q.Get("sort"), Search: strings.TrimSpace(q.Get("q"))}
+	if _, ok := sorts[filter.Sort]; !ok {
+		filter.Sort = ""
+	}
+	var err error
+	if _, ok := windows[q.Get("window")]; ok {
+		filter.Window = q.Get("window")
+	}
+	if from := q.Get("from"); from != "" {
+		if filter.From, err = time.Parse(dateLayout, from); err != nil {
+			return filter, errors.Wrapf(err, "invalid from %q", from)
+		}
+	}
+	if to := q.Get("to"); to != "" {
+		if filter.To, err = time.Parse(dateLayout, to); err != nil {
+			return filter, errors.Wrapf(err, "invalid to %q", to)
+		}
+	}
+	if min := q.Get("min_reactions"); min != "" {
+		if filter.MinReactions, err = strconv.Atoi(min); err != nil {
+			return filter, errors.Wrapf(err, "invalid min_reactions %q", min)
+		}
+	}
+	if after := q.Get("after"); after != "" {
+		filter.After, err = parseCursor(after)
+	} else if before := q.Get("before"); before != "" {
+		filter.Before, err = parseCursor(before)
+	}
+	return filter, err
+}
+
+// publishFilter publishes the payload fetching the comments that filter
+// selects, so that they are up to date next time. Its target is tracked once
+// found, to keep them up to date while it is visited.
+func publishFilter(ctx context.Context, broker *broker, scheduler *scheduler, filter commentFilter) error {
+	var t target
+	switch {
+	case filter.Org != "":
+		t = target{Type: "org", Name: filter.Org}
+	case filter.Repo != "":
+		t = target{Type: "repo", Name: filter.Repo}
+	case filter.User != "":
+		t = target{Type: "user", Name: filter.User}
+	default:
+		return nil
+	}
+	if err := broker.Publish("queue-fetch", priorityInteractive, t.job()); err != nil {
+		return err
+	}
+	return scheduler.visit(ctx, t)
+}
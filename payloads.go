@@ -6,42 +6,175 @@ import (
 	"time"
 
 	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
 )
 
 type payload struct {
 	Type        string
+	Key         string   `json:",omitempty"`
+	Priority    priority `json:",omitempty"`
 	PublishedAt time.Time
 	Payload     json.RawMessage
+
+	// Set by receiver when the handler fails
+	Attempts  int        `json:",omitempty"`
+	LastError string     `json:",omitempty"`
+	FailedAt  *time.Time `json:",omitempty"`
+}
+
+func (p payload) MarshalBinary() ([]byte, error) { return json.Marshal(p) }
+
+// job is implemented by the payloads that can be published.
+type job interface {
+	typ() string
+	key() string // identifies the target, for deduplication
+}
+
+func newPayload(j job, prio priority) (payload, error) {
+	raw, err := json.Marshal(j)
+	return payload{
+		Type:        j.typ(),
+		Key:         j.key(),
+		PublishedAt: time.Now(),
+		Payload:     raw,
+		Priority:    prio,
+	}, errors.WithStack(err)
 }
 
 type repoPayload struct {
 	Owner, Name string
 	Page        int
+	// Track is set on payloads fetching a target, to track it once found
+	Track bool `json:",omitempty"`
+
+	// Since is the high-water mark of the last complete sync, and SyncedAt
+	// the one of the sync in progress, set from its first page.
+	Since, SyncedAt time.Time
 }
 
-func (r repoPayload) MarshalBinary() ([]byte, error) {
-	raw, _ := json.Marshal(r)
-	return json.Marshal(payload{Type: "repo", PublishedAt: time.Now(), Payload: raw})
+func (r repoPayload) typ() string { return "repo" }
+
+func (r repoPayload) key() string {
+	return fmt.Sprintf("repo:%s/%s:%d", r.Owner, r.Name, firstPage(r.Page))
 }
 
-type userPayload struct {
+// orgPayload lists the repos of an organization, to fetch each of them.
+type orgPayload struct {
 	Login string
 	Page  int
+	Track bool `json:",omitempty"`
 }
 
-func (u userPayload) MarshalBinary() ([]byte, error) {
-	raw, _ := json.Marshal(u)
-	return json.Marshal(payload{Type: "user", PublishedAt: time.Now(), Payload: raw})
+func (o orgPayload) typ() string { return "org" }
+
+func (o orgPayload) key() string { return fmt.Sprintf("org:%s:%d", o.Login, firstPage(o.Page)) }
+
+type userPayload struct {
+	Login string
+	Page  int
+	Track bool `json:",omitempty"`
 }
 
+func (u userPayload) typ() string { return "user" }
+
+func (u userPayload) key() string { return fmt.Sprintf("user:%s:%d", u.Login, firstPage(u.Page)) }
+
 type issuePayload struct {
 	URL  string
 	Page int
+
+	// set from the first page, the comments not seen since are deleted
+	StartedAt time.Time
 }
 
-func (i issuePayload) MarshalBinary() ([]byte, error) {
-	raw, _ := json.Marshal(i)
-	return json.Marshal(payload{Type: "issue", PublishedAt: time.Now(), Payload: raw})
+func (i issuePayload) typ() string { return "issue" }
+
+func (i issuePayload) key() string { return fmt.Sprintf("issue:%s:%d", i.URL, firstPage(i.Page)) }
+
+// pullPayload lists the review comments of the pull request of issue URL.
+type pullPayload struct {
+	URL  string
+	Page int
+
+	// set from the first page, the review comments not seen since are
+	// deleted
+	StartedAt time.Time
+}
+
+func (p pullPayload) typ() string { return "pull" }
+
+func (p pullPayload) key() string { return fmt.Sprintf("pull:%s:%d", p.URL, firstPage(p.Page)) }
+
+// commitCommentsPayload lists the comments on the commits of a repo.
+type commitCommentsPayload struct {
+	Owner, Name string
+	Page        int
+}
+
+func (c commitCommentsPayload) typ() string { return "commit" }
+
+func (c commitCommentsPayload) key() string {
+	return fmt.Sprintf("commit:%s/%s:%d", c.Owner, c.Name, firstPage(c.Page))
+}
+
+// teamsPayload lists the teams of an org, to list their discussions.
+type teamsPayload struct {
+	Org  string
+	Page int
+}
+
+func (t teamsPayload) typ() string { return "teams" }
+
+func (t teamsPayload) key() string { return fmt.Sprintf("teams:%s:%d", t.Org, firstPage(t.Page)) }
+
+// discussionsPayload lists the discussions of a team.
+type discussionsPayload struct {
+	Org    string
+	TeamID int64
+	Page   int
+}
+
+func (d discussionsPayload) typ() string { return "discussions" }
+
+func (d discussionsPayload) key() string {
+	return fmt.Sprintf("discussions:%d:%d", d.TeamID, firstPage(d.Page))
+}
+
+// discussionPayload lists the comments of a team discussion.
+type discussionPayload struct {
+	Org    string
+	TeamID int64
+	Number int
+	Page   int
+}
+
+func (d discussionPayload) typ() string { return "discussion" }
+
+func (d discussionPayload) key() string {
+	return fmt.Sprintf("discussion:%d/%d:%d", d.TeamID, d.Number, firstPage(d.Page))
+}
+
+// reactionsPayload fetches a single stored comment or issue again, to
+// refresh its reactions.
+type reactionsPayload struct {
+	Kind string
+	Repo string // owner/name, or the org of team discussion comments
+	ID   int64
+	// the API URL of the issue, for issue bodies, or of the team discussion
+	// comment
+	URL string `json:",omitempty"`
+}
+
+func (r reactionsPayload) typ() string { return "reactions" }
+
+func (r reactionsPayload) key() string { return fmt.Sprintf("reactions:%s:%d", r.Kind, r.ID) }
+
+// firstPage returns 1 for page 0, as GitHub does.
+func firstPage(page int) int {
+	if page == 0 {
+		return 1
+	}
+	return page
 }
 
 type githubRate github.Rate
@@ -56,6 +189,7 @@ type githubRequest struct {
 	StatusCode  int
 	LastPage    int
 	Duration    time.Duration
+	Cached      bool `json:",omitempty"`
 }
 
 func (r *githubRequest) MarshalBinary() ([]byte, error) { return json.Marshal(r) }
@@ -73,5 +207,5 @@ func (r githubRequest) String() string {
 		}
 		message = fmt.Sprintf("%s (%d/%d)", message, page, lastPage)
 	}
-	return fmt.Sprintf("ts=%s msg=%q status=%d duration=%s", r.Timestamp.Format(time.RFC3339), message, r.StatusCode, r.Duration)
+	return fmt.Sprintf("ts=%s msg=%q status=%d cached=%t duration=%s", r.Timestamp.Format(time.RFC3339), message, r.StatusCode, r.Cached, r.Duration)
 }
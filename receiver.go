@@ -2,16 +2,26 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
+	"math/rand"
 	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
 )
 
-type receiver struct{ redis *redis.Client }
+type receiver struct {
+	backend backend
+	cache   *cache // to publish the counts of queues
 
-func newReceiver(redis *redis.Client) *receiver { return &receiver{redis: redis} }
+	// cooldowns holds, by payload type, for how long a completed payload
+	// prevents broker.Publish from publishing a payload with the same key
+	cooldowns map[string]time.Duration
+}
+
+func newReceiver(backend backend, cache *cache, cooldowns map[string]time.Duration) *receiver {
+	return &receiver{backend: backend, cache: cache, cooldowns: cooldowns}
+}
 
 type handler func(context.Context, []byte) error
 
@@ -29,21 +39,18 @@ func (r *receiver) Consume(ctx context.Context, queue string, f handler) error {
 }
 
 func (r *receiver) consumeLoop(ctx context.Context, queue string, f handler, cerr chan error) {
-	processing := queue + "-processing"
-
-	// TODO: republish message in processing back to queue?
-
 	type msg struct {
 		bytes []byte
 		err   error
 	}
-	brpoplpush := make(chan msg)
+	// buffered, so that a pending pop doesn't leak its goroutine on shutdown;
+	// what it moved to processing will be requeued by Sweep
+	popc := make(chan msg, 1)
 
 	for {
 		go func() {
-			// TODO: acquire lock? see https://stackoverflow.com/a/34754632
-			bytes, err := r.redis.BRPopLPush(queue, processing, time.Minute).Bytes()
-			brpoplpush <- msg{bytes: bytes, err: err}
+			bytes, _, err := r.backend.Pop(queue, lanes(queue), time.Second)
+			popc <- msg{bytes: bytes, err: err}
 		}()
 
 		var payload []byte
@@ -51,50 +58,189 @@ func (r *receiver) consumeLoop(ctx context.Context, queue string, f handler, cer
 		case <-ctx.Done():
 			cerr <- nil
 			return
-		case msg := <-brpoplpush:
-			if err := msg.err; err == redis.Nil {
-				continue
-			} else if err != nil {
-				cerr <- errors.WithStack(err)
-				return
-			}
-
-			if err := r.incrByAndPublish(queue+"-count", -1); err != nil {
+		case msg := <-popc:
+			if err := msg.err; err != nil {
 				cerr <- err
 				return
 			}
-			if err := r.incrByAndPublish(processing+"-count", 1); err != nil {
-				cerr <- err
-				return
+			if msg.bytes == nil {
+				continue
 			}
-
 			payload = msg.bytes
 		}
 
-		if err := f(ctx, payload); errors.Cause(err) == context.Canceled {
+		stop := r.heartbeat(queue, payload)
+		err := f(ctx, payload)
+		stop()
+		if errors.Cause(err) == context.Canceled {
+			// leave the payload in processing, sweep will requeue it
 			cerr <- nil
+			return
+		} else if derr, ok := err.(*deferError); ok {
+			log.Printf("deferred until %s: %v", derr.at.Format(time.RFC3339), derr.err)
+			// the payload is still pending, its key is not released
+			if err := r.backend.Retry(queue, payload, payload, derr.at); err != nil {
+				cerr <- err
+				return
+			}
+			continue
 		} else if err != nil {
 			log.Printf("%+v\n", err)
+			if err := r.retry(queue, payload, err); err != nil {
+				cerr <- err
+				return
+			}
 			continue
 		}
 
-		res, err := r.redis.LRem(processing, 0, payload).Result()
-		if err != nil {
-			cerr <- errors.WithStack(err)
-			return
-		}
-
-		if err := r.incrByAndPublish(processing+"-count", -res); err != nil {
+		if err := r.complete(queue, payload); err != nil {
 			cerr <- err
 			return
 		}
 	}
 }
 
-func (r *receiver) incrByAndPublish(key string, value int64) error {
-	res, err := r.redis.IncrBy(key, value).Result()
+// complete removes payload from processing, and starts the cooldown of its
+// key.
+func (r *receiver) complete(queue string, b []byte) error {
+	var p payload
+	if err := json.Unmarshal(b, &p); err != nil {
+		return errors.WithStack(err)
+	}
+	return r.backend.Ack(queue, b, p.Key, r.cooldowns[p.Type])
+}
+
+// deferError is returned by handlers to schedule their payload again at at,
+// without counting an attempt, when err is not the fault of the payload.
+type deferError struct {
+	at  time.Time
+	err error
+}
+
+func (e *deferError) Error() string { return e.err.Error() }
+
+// permanentError is returned by handlers when consuming their payload again
+// would fail the same way, to move it to the dead payloads at once.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+const (
+	maxRetries     = 5
+	retryBaseDelay = 10 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// retry schedules payload to be consumed again after an exponential backoff,
+// or moves it to the dead payloads once it failed more than maxRetries times
+// or when ferr is a permanentError.
+func (r *receiver) retry(queue string, b []byte, ferr error) error {
+	var p payload
+	if err := json.Unmarshal(b, &p); err != nil {
+		// it can't be consumed nor annotated, bury it as is
+		log.Printf("%+v\n", errors.WithStack(err))
+		return r.backend.Bury(queue, b, b, "")
+	}
+	p.Attempts++
+	p.LastError = ferr.Error()
+	now := time.Now()
+	p.FailedAt = &now
+	retried, err := p.MarshalBinary()
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	return errors.WithStack(r.redis.Publish(key, res).Err())
+
+	if _, permanent := errors.Cause(ferr).(*permanentError); permanent || p.Attempts > maxRetries {
+		return r.backend.Bury(queue, b, retried, p.Key)
+	}
+	return r.backend.Retry(queue, b, retried, now.Add(backoff(p.Attempts)))
+}
+
+// backoff returns the delay before the given attempt, doubling from
+// retryBaseDelay up to retryMaxDelay, with jitter.
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt-1)
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// heartbeat refreshes the claim on payload until the returned func is called,
+// so that long running handlers are not mistaken for abandoned ones.
+func (r *receiver) heartbeat(queue string, payload []byte) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := r.backend.Claim(queue, payload); err != nil {
+					log.Printf("%+v\n", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+const heartbeatInterval = 30 * time.Second
+
+// Sweep periodically moves payloads that have been in processing for longer
+// than timeout back to their lane of queue, and scheduled payloads that are
+// due to their lane. Payloads end up stranded in processing when the process
+// dies while handling them. Sweep also publishes the counts of the lists of
+// queue when they change.
+func (r *receiver) Sweep(ctx context.Context, queue string, timeout time.Duration) error {
+	if timeout < 2*heartbeatInterval {
+		timeout = 2 * heartbeatInterval
+	}
+	abandoned := time.NewTicker(timeout / 2)
+	defer abandoned.Stop()
+	scheduled := time.NewTicker(time.Second)
+	defer scheduled.Stop()
+
+	if err := r.backend.RequeueAbandoned(queue, time.Now().Add(-timeout)); err != nil {
+		return err
+	}
+	published := make(map[string]int64)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-abandoned.C:
+			if err := r.backend.RequeueAbandoned(queue, time.Now().Add(-timeout)); err != nil {
+				return err
+			}
+		case <-scheduled.C:
+			if err := r.backend.Promote(queue, time.Now()); err != nil {
+				return err
+			}
+			if err := r.publishCounts(queue, published); err != nil {
+				log.Printf("%+v\n", err)
+			}
+		}
+	}
+}
+
+// publishCounts publishes the counts of the lists of queue that changed since
+// published, and updates published.
+func (r *receiver) publishCounts(queue string, published map[string]int64) error {
+	counts, err := r.backend.Counts(queue)
+	if err != nil {
+		return err
+	}
+	for list, count := range counts {
+		if last, ok := published[list]; ok && last == count {
+			continue
+		}
+		if err := r.cache.Publish(list+"-count", count); err != nil {
+			return err
+		}
+		published[list] = count
+	}
+	return nil
 }
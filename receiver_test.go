@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRetry(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		body []byte
+		err  error
+		want map[string]int64
+	}{
+		{"transient", testPayload(t, "a", priorityDefault), errors.New("timeout"), map[string]int64{"test-scheduled": 1}},
+		{"permanent", testPayload(t, "a", priorityDefault), &permanentError{err: errors.New("not found")}, map[string]int64{"test-dead": 1}},
+		{"wrapped permanent", testPayload(t, "a", priorityDefault), errors.Wrap(&permanentError{err: errors.New("not found")}, "fetch"), map[string]int64{"test-dead": 1}},
+		{"undecodable", []byte("{"), errors.New("unexpected EOF"), map[string]int64{"test-dead": 1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemoryBackend()
+			if _, err := m.Push("test", "test", "a", test.body); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			mustPop(t, m, "test", test.body, "test")
+
+			r := newReceiver(m, nil, nil)
+			if err := r.retry("test", test.body, test.err); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			test.want["test-processing"] = 0
+			mustCount(t, m, "test", test.want)
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+
+	blackfriday "gopkg.in/russross/blackfriday.v2"
+)
+
+// renderMarkdown renders the markdown of a comment to sanitized HTML.
+func renderMarkdown(in string) string {
+	return sanitizeHTML(string(blackfriday.Run(
+		[]byte(in),
+		blackfriday.WithExtensions(blackfriday.CommonExtensions|blackfriday.HardLineBreak),
+	)))
+}
+
+// allowedTags holds the tags sanitizeHTML keeps, with their allowed
+// attributes.
+var allowedTags = map[string][]string{
+	"a": {"href", "title"}, "abbr": {"title"}, "b": nil, "blockquote": nil,
+	"br": nil, "code": {"class"}, "dd": nil, "del": nil, "details": {"open"},
+	"div": nil, "dl": nil, "dt": nil, "em": nil, "h1": nil, "h2": nil,
+	"h3": nil, "h4": nil, "h5": nil, "h6": nil, "hr": nil, "i": nil,
+	"img": {"src", "alt", "title", "width", "height"}, "ins": nil, "kbd": nil,
+	"li": nil, "ol": {"start"}, "p": nil, "pre": nil, "q": nil, "s": nil,
+	"samp": nil, "span": nil, "strike": nil, "strong": nil, "sub": nil,
+	"summary": nil, "sup": nil, "table": nil, "tbody": nil,
+	"td": {"align", "colspan", "rowspan"}, "tfoot": nil,
+	"th": {"align", "colspan", "rowspan"}, "thead": nil, "tr": nil, "tt": nil,
+	"ul": nil,
+}
+
+// voidTags are the allowed tags that have no end tag.
+var voidTags = map[string]bool{"br": true, "hr": true, "img": true}
+
+// droppedTags are removed with their content, instead of just their tags.
+// They map to the regexp of their end tag.
+var droppedTags = func() map[string]*regexp.Regexp {
+	m := make(map[string]*regexp.Regexp)
+	for _, name := range []string{"script", "style", "iframe", "object", "embed", "noscript", "textarea", "title", "template", "svg", "math", "xmp"} {
+		m[name] = regexp.MustCompile(`(?i)</` + name + `\s*>`)
+	}
+	return m
+}()
+
+var (
+	tagRegexp     = regexp.MustCompile(`<!--[\s\S]*?-->|<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[^\s"'>/=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*)\s*/?>`)
+	attrRegexp    = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+	strayRegexp   = regexp.MustCompile(`[<>]`)
+	urlSchemes    = map[string]bool{"": true, "http": true, "https": true, "mailto": true}
+	urlAttributes = map[string]bool{"href": true, "src": true}
+)
+
+// highlight escapes the headline of a search, and replaces the delimiters of
+// its matches set by headlineOptions with marks.
+func highlight(headline string) template.HTML {
+	var (
+		b    strings.Builder
+		open bool
+	)
+	for _, r := range headline {
+		switch {
+		case r == '\ue000' && !open:
+			b.WriteString("<mark>")
+			open = true
+		case r == '\ue001' && open:
+			b.WriteString("</mark>")
+			open = false
+		case r == '\ue000' || r == '\ue001':
+		default:
+			b.WriteString(html.EscapeString(string(r)))
+		}
+	}
+	if open {
+		b.WriteString("</mark>")
+	}
+	return template.HTML(b.String())
+}
+
+// sanitizeHTML keeps the tags and attributes of the allow-list in s, which
+// is the HTML rendered from a comment, and escapes the rest. Only relative,
+// http, https and mailto URLs are kept, and the tags left open are closed.
+func sanitizeHTML(s string) string {
+	var (
+		b    strings.Builder
+		open []string // the allowed tags left open
+	)
+	for s != "" {
+		loc := tagRegexp.FindStringSubmatchIndex(s)
+		if loc == nil {
+			b.WriteString(escapeStray(s))
+			break
+		}
+		b.WriteString(escapeStray(s[:loc[0]]))
+		tag := s[loc[0]:loc[1]]
+		s = s[loc[1]:]
+		if loc[4] < 0 { // comment
+			continue
+		}
+		closing := loc[3] > loc[2]
+		name := strings.ToLower(tag[loc[4]-loc[0] : loc[5]-loc[0]])
+
+		if endRegexp, ok := droppedTags[name]; ok {
+			if !closing {
+				// skip to the end tag, or to the end
+				end := endRegexp.FindStringIndex(s)
+				if end == nil {
+					s = ""
+				} else {
+					s = s[end[1]:]
+				}
+			}
+			continue
+		}
+		attrs, ok := allowedTags[name]
+		if !ok {
+			continue
+		}
+
+		if closing {
+			// close the tags left open inside, ignore end tags that were
+			// not opened
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == name {
+					for j := len(open) - 1; j >= i; j-- {
+						b.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+			continue
+		}
+
+		b.WriteString("<" + name)
+		for _, m := range attrRegexp.FindAllStringSubmatch(tag[loc[6]-loc[0]:loc[7]-loc[0]], -1) {
+			attr := strings.ToLower(m[1])
+			if !contains(attrs, attr) {
+				continue
+			}
+			value := html.UnescapeString(m[2] + m[3] + m[4])
+			if urlAttributes[attr] && !safeURL(value) {
+				continue
+			}
+			b.WriteString(" " + attr + `="` + html.EscapeString(value) + `"`)
+		}
+		b.WriteString(">")
+		if !voidTags[name] {
+			open = append(open, name)
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	return b.String()
+}
+
+// escapeStray escapes the < and > of text, which is between tags. Entities
+// are kept as they are.
+func escapeStray(text string) string {
+	return strayRegexp.ReplaceAllStringFunc(text, html.EscapeString)
+}
+
+// safeURL returns whether the scheme of u is allowed. Browsers ignore the
+// whitespace and control characters in schemes, so they are removed first.
+func safeURL(u string) bool {
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+	parsed, err := url.Parse(u)
+	return err == nil && urlSchemes[strings.ToLower(parsed.Scheme)]
+}
+
+func contains(ss []string, s string) bool {
+	for i := range ss {
+		if ss[i] == s {
+			return true
+		}
+	}
+	return false
+}
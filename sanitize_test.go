@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"html"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	for _, test := range []struct{ in, want string }{
+		// schemes
+		{`<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="JaVaScRiPt:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href=javascript:alert(1)>x</a>`, `<a>x</a>`},
+		{`<a href="vbscript:msgbox(1)">x</a>`, `<a>x</a>`},
+		{`<img src="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">`, `<img>`},
+		{`<a href="jav&#x61;script:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="javascript&colon;alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="java&#x09;script:alert(1)">x</a>`, `<a>x</a>`},
+		{"<a href=\"java\nscript:alert(1)\">x</a>", `<a>x</a>`},
+		{"<a href=\"\x01 javascript:alert(1)\">x</a>", `<a>x</a>`},
+		{`<a href="&#14;javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="https://example.com/?q=javascript:">x</a>`, `<a href="https://example.com/?q=javascript:">x</a>`},
+		{`<a href="//example.com">x</a>`, `<a href="//example.com">x</a>`},
+		{`<a href="mailto:a@example.com">x</a>`, `<a href="mailto:a@example.com">x</a>`},
+
+		// attributes
+		{`<img src=x onerror=alert(1)>`, `<img src="x">`},
+		{`<a href="https://example.com" onmouseover="alert(1)">x</a>`, `<a href="https://example.com">x</a>`},
+		{`<a href="https://example.com" ONCLICK=alert(1)>x</a>`, `<a href="https://example.com">x</a>`},
+		{`<details open ontoggle=alert(1)>`, `<details open=""></details>`},
+		{`<p style="background:url(javascript:alert(1))">x</p>`, `<p>x</p>`},
+		{`<img/src=x/onerror=alert(1)>`, `&lt;img/src=x/onerror=alert(1)&gt;`},
+		{
+			`<a href="https://example.com" title='"><script>alert(1)</script>'>x</a>`,
+			`<a href="https://example.com" title="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;">x</a>`,
+		},
+
+		// dropped tags and nesting
+		{`<script>alert(1)</script>`, ``},
+		{`<SCRIPT SRC=https://example.com/xss.js></SCRIPT>`, ``},
+		{`<scr<script>ipt>alert(1)</script>`, `&lt;scr`},
+		{"<scr\x00ipt>alert(1)</script>", "&lt;scr\x00ipt&gt;alert(1)"},
+		{`<svg><script>alert(1)</script></svg>`, ``},
+		{`<svg onload=alert(1)>`, ``},
+		{`<svg><a xlink:href="javascript:alert(1)"><text>x</text></a></svg>after`, `after`},
+		{`<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>`, ``},
+		{`<math href="javascript:alert(1)">x</math>`, ``},
+		{`<iframe src="https://example.com"></iframe>`, ``},
+		{`<iframe srcdoc="<script>alert(1)</script>">`, ``},
+		{`<textarea><img src=x onerror=alert(1)></textarea>`, ``},
+		{`<noscript><p title="</noscript><img src=x onerror=alert(1)>">`, `<img src="x">"&gt;`},
+
+		// comments
+		{`<!--><img src=x onerror=alert(1)>-->`, ``},
+		{`<!-- --!><img src=x onerror=alert(1)>-->`, ``},
+		{`<!--[if gte IE 4]><script>alert(1)</script><![endif]-->`, ``},
+		{`<!-- <img src=x onerror=alert(1)>`, `&lt;!-- <img src="x">`},
+
+		// unclosed tags
+		{`<b><i>x`, `<b><i>x</i></b>`},
+		{`<div><p>x</div>`, `<div><p>x</p></div>`},
+		{`</p></div><p>x`, `<p>x</p>`},
+		{`<a href="x>y`, `&lt;a href="x&gt;y`},
+		{`<img src="x" onerror="alert(1)"`, `&lt;img src="x" onerror="alert(1)"`},
+	} {
+		got := sanitizeHTML(test.in)
+		if got != test.want {
+			t.Errorf("sanitizeHTML(%q) = %q, want %q", test.in, got, test.want)
+		}
+		if found := executable(got); len(found) > 0 {
+			t.Errorf("sanitizeHTML(%q) = %q, executable: %q", test.in, got, found)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, in := range []string{
+		"[x](javascript:alert(1))",
+		"[x](jav&#x61;script:alert(1))",
+		"![x](javascript:alert(1))",
+		"<javascript:alert(1)>",
+		"[x]: javascript:alert(1)\n\n[y][x]",
+		"<script>alert(1)</script>",
+		"`<script>alert(1)</script>`",
+		"```\n<script>alert(1)</script>\n```",
+		"<img src=x onerror=alert(1)>",
+		"<details><summary>x</summary><svg onload=alert(1)></details>",
+	} {
+		got := renderMarkdown(in)
+		if found := executable(got); len(found) > 0 {
+			t.Errorf("renderMarkdown(%q) = %q, executable: %q", in, got, found)
+		}
+	}
+}
+
+// hostileComments returns a comment of each kind, with hostile values in
+// every field that is rendered.
+func hostileComments() []comment {
+	const (
+		tag = `"'><img src=x onerror=alert(1)>`
+		url = "javascript:alert(1)"
+	)
+	var comments []comment
+	for _, kind := range []string{"issue", "body", "review", "commit", "discussion"} {
+		comments = append(comments, comment{
+			Kind: kind,
+			Comment: github.IssueComment{
+				ID:        github.Int64(1),
+				Body:      github.String(`<script>alert(1)</script><a href="javascript:alert(1)" onclick=alert(1)>x</a>` + tag),
+				HTMLURL:   github.String(url),
+				User:      &github.User{Login: github.String(tag), AvatarURL: github.String(url)},
+				Reactions: &github.Reactions{TotalCount: github.Int(2), PlusOne: github.Int(1), Heart: github.Int(1)},
+				CreatedAt: &time.Time{},
+				UpdatedAt: &time.Time{},
+			},
+			Repo:      tag + "/" + tag,
+			Path:      tag,
+			DiffHunk:  "@@ -1 +1 @@\n-</pre>" + tag,
+			CommitID:  tag,
+			Team:      tag,
+			Title:     "</title><script>alert(1)</script>" + tag,
+			Snippet:   highlight("<script>alert(1)</script>" + tag),
+			Sparkline: []int{1, 2},
+			Gained:    1,
+		})
+	}
+	return comments
+}
+
+// benignComments returns the comments of hostileComments with harmless
+// values, rendered to what the templates may execute themselves.
+func benignComments() []comment {
+	comments := hostileComments()
+	for i := range comments {
+		c := &comments[i]
+		c.Comment.Body = github.String("body")
+		c.Comment.HTMLURL = github.String("https://github.com/o/r/issues/1")
+		c.Comment.User = &github.User{Login: github.String("u"), AvatarURL: github.String("https://example.com/u.png")}
+		c.Repo, c.Path, c.DiffHunk, c.CommitID, c.Title = "o/r", "p", "d", "c", "t"
+		c.Snippet = highlight("s")
+	}
+	return comments
+}
+
+func TestTemplates(t *testing.T) {
+	template := parseTemplates()
+	render := func(name string, comments []comment, filter commentFilter) string {
+		var b bytes.Buffer
+		var err error
+		switch name {
+		case "index.html":
+			err = template.ExecuteTemplate(&b, name, struct {
+				Duration   time.Duration
+				Comments   []comment
+				Next, Prev *cursor
+				Filter     commentFilter
+			}{Comments: comments, Filter: filter})
+		case "trending.html":
+			err = template.ExecuteTemplate(&b, name, struct {
+				Duration time.Duration
+				Comments []comment
+				Window   string
+			}{Comments: comments, Window: "7d"})
+		default:
+			err = template.ExecuteTemplate(&b, name, comments[0])
+		}
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return b.String()
+	}
+
+	for _, name := range []string{"index.html", "trending.html", "comment"} {
+		benign := executable(render(name, benignComments(), commentFilter{Search: "s"}))
+		hostile := render(name, hostileComments(), commentFilter{Search: `"'><img src=x onerror=alert(1)>`})
+		if found := unexpected(executable(hostile), benign); len(found) > 0 {
+			t.Errorf("%s executable: %q", name, found)
+		}
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	comments := hostileComments()
+	filter := commentFilter{User: `"'><img src=x onerror=alert(1)>`}
+
+	w := httptest.NewRecorder()
+	if err := writeAtom(w, httptest.NewRequest("GET", "/?feed=atom", nil), filter, comments); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var atom atomFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &atom); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(atom.Entries) != len(comments) {
+		t.Fatalf("got %d Atom entries, want %d", len(atom.Entries), len(comments))
+	}
+	for _, e := range atom.Entries {
+		if found := executable(e.Content.Body); len(found) > 0 {
+			t.Errorf("Atom content executable: %q", found)
+		}
+		if !testSafeURL(e.Link.Href) || !testSafeURL(e.Author.URI) {
+			t.Errorf("Atom links to %q and %q", e.Link.Href, e.Author.URI)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	if err := writeRSS(w, httptest.NewRequest("GET", "/?feed=rss", nil), filter, comments); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var rss rssFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(rss.Channel.Items) != len(comments) {
+		t.Fatalf("got %d RSS items, want %d", len(rss.Channel.Items), len(comments))
+	}
+	for _, item := range rss.Channel.Items {
+		if found := executable(item.Description); len(found) > 0 {
+			t.Errorf("RSS description executable: %q", found)
+		}
+		if !testSafeURL(item.Link) || item.GUID.IsPermaLink && !testSafeURL(item.GUID.Value) {
+			t.Errorf("RSS links to %q and %q", item.Link, item.GUID.Value)
+		}
+	}
+}
+
+// These regexps are looser than the ones of sanitizeHTML, so that they find
+// what browsers would parse as tags: after the escaping of text, every < left
+// starts a tag, and > can't appear in escaped attribute values.
+var (
+	testTagRegexp  = regexp.MustCompile(`<!--|<([a-zA-Z][^\s/>]*)([^>]*)>?`)
+	testAttrRegexp = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+)))?`)
+	testTags       = map[string]bool{
+		"script": true, "style": true, "iframe": true, "frame": true, "object": true,
+		"embed": true, "svg": true, "math": true, "base": true, "link": true,
+		"meta": true, "form": true, "template": true, "noscript": true,
+	}
+	testURLAttributes = map[string]bool{
+		"href": true, "src": true, "action": true, "formaction": true,
+		"xlink:href": true, "data": true, "poster": true, "background": true,
+	}
+)
+
+// executable returns the comments, tags, event handlers, styles and URLs of
+// the HTML out that could run scripts.
+func executable(out string) []string {
+	var found []string
+	for _, m := range testTagRegexp.FindAllStringSubmatch(out, -1) {
+		if m[0] == "<!--" {
+			found = append(found, m[0])
+			continue
+		}
+		name := strings.ToLower(m[1])
+		if testTags[name] {
+			found = append(found, m[0])
+		}
+		for _, a := range testAttrRegexp.FindAllStringSubmatch(m[2], -1) {
+			attr, value := strings.ToLower(a[1]), html.UnescapeString(a[2]+a[3]+a[4])
+			switch {
+			case strings.HasPrefix(attr, "on"), attr == "style", attr == "srcdoc",
+				testURLAttributes[attr] && !testSafeURL(value):
+				found = append(found, name+" "+attr+"="+value)
+			}
+		}
+	}
+	return found
+}
+
+// testSafeURL returns whether u is relative, or an http, https or mailto URL,
+// ignoring the characters browsers strip from schemes.
+func testSafeURL(u string) bool {
+	u = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u))
+	i := strings.IndexAny(u, ":/?#")
+	if i < 0 || u[i] != ':' {
+		return true
+	}
+	switch u[:i] {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// unexpected returns the elements of found that are not in expected.
+func unexpected(found, expected []string) []string {
+	var diff []string
+	for _, f := range found {
+		if !contains(expected, f) {
+			diff = append(diff, f)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// scheduler periodically publishes the payloads of the tracked targets, the
+// users, orgs and repos whose pages were visited, so that they don't go stale
+// when nobody visits them. It also refreshes the reactions of hot comments,
+// which don't change their updated_at.
+type scheduler struct {
+	broker *broker
+	cache  *cache
+	store  *store
+
+	// interval is how often targets are fetched, unless intervals holds
+	// another one for their type. Targets that are not visited for
+	// expiryIntervals intervals are not tracked anymore.
+	interval  time.Duration
+	intervals map[string]time.Duration
+	// share is the part of the remaining rate limits that scheduled payloads
+	// may use, the rest is left to visits
+	share float64
+}
+
+func newScheduler(broker *broker, cache *cache, store *store, interval time.Duration, intervals map[string]time.Duration, share float64) *scheduler {
+	return &scheduler{broker: broker, cache: cache, store: store, interval: interval, intervals: intervals, share: share}
+}
+
+const (
+	expiryIntervals = 7
+	// maxIntervalFactor bounds how much the interval of a target grows while
+	// its fetches find nothing new
+	maxIntervalFactor = 8
+)
+
+// track tracks the target t once a fetch found it, and schedules its next
+// fetch. The interval of t is reset to the one of its type when active, that
+// is when the fetch found something new, and doubles otherwise.
+func (s *scheduler) track(ctx context.Context, t target, active bool) error {
+	interval, ok := s.intervals[t.Type]
+	if !ok {
+		interval = s.interval
+	}
+	return s.store.trackTarget(ctx, t, interval, maxIntervalFactor*interval, active)
+}
+
+// visit records that the page of t was visited, which keeps t tracked.
+func (s *scheduler) visit(ctx context.Context, t target) error {
+	return s.store.visitTarget(ctx, t)
+}
+
+const scheduleTick = time.Minute
+
+// targetCosts are rough estimates of the requests made by the payload of
+// each type of target, by rate limit.
+var targetCosts = map[string]struct {
+	rate string
+	cost int
+}{
+	"repo": {"github-core-rate", 10},
+	"org":  {"github-core-rate", 50},
+	"user": {"github-search-rate", 2},
+}
+
+// Run schedules the due targets every scheduleTick, until ctx is
+// canceled.
+func (s *scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := s.schedule(ctx); err != nil {
+				log.Printf("%+v", err)
+			}
+		}
+	}
+}
+
+// unknownBudget is the number of requests spent by schedule when the
+// remaining rate limit is unknown, until the first request or after a reset.
+const unknownBudget = 20
+
+// schedule publishes the payloads of the due targets of each type, as many
+// as the budget of their rate limit allows. The rest of the core budget
+// refreshes the reactions of hot comments.
+func (s *scheduler) schedule(ctx context.Context) error {
+	if n, err := s.store.expireTargets(ctx, time.Now().Add(-expiryIntervals*s.interval)); err != nil {
+		return err
+	} else if n > 0 {
+		log.Printf("stopped tracking %d targets that were not visited", n)
+	}
+
+	budgets := make(map[string]int)
+	for _, key := range []string{"github-core-rate", "github-search-rate"} {
+		rate, err := s.cache.rate(key)
+		if err != nil {
+			return err
+		}
+		budgets[key] = unknownBudget
+		if rate != nil {
+			budgets[key] = s.budget(rate)
+		}
+	}
+
+	for typ, c := range targetCosts {
+		n := budgets[c.rate] / c.cost
+		if n == 0 {
+			continue
+		}
+		targets, err := s.store.dueTargets(ctx, typ, n)
+		if err != nil {
+			return err
+		}
+		for _, t := range targets {
+			if err := s.broker.Publish("queue-fetch", priorityDefault, t.job()); err != nil {
+				return err
+			}
+			// until the fetch tracks it again
+			if err := s.store.postponeTarget(ctx, t); err != nil {
+				return err
+			}
+		}
+		budgets[c.rate] -= len(targets) * c.cost
+	}
+
+	if budgets["github-core-rate"] <= 0 {
+		return nil
+	}
+	// a refresh costs a single request
+	payloads, err := s.store.hotComments(ctx, budgets["github-core-rate"])
+	if err != nil {
+		return err
+	}
+	for _, p := range payloads {
+		if err := s.broker.Publish("queue-fetch", priorityBackfill, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// budget returns the number of requests of rate that can be spent until the
+// next schedule, spreading share of the remaining ones until the reset.
+func (s *scheduler) budget(rate *github.Rate) int {
+	remaining := float64(rate.Remaining) * s.share
+	if untilReset := time.Until(rate.Reset.Time); untilReset > scheduleTick {
+		remaining = remaining * float64(scheduleTick) / float64(untilReset)
+	}
+	return int(remaining)
+}
+
+// target is a user, org or repo to fetch periodically.
+type target struct {
+	Type string // the type of its payload
+	Name string // login, or owner/name
+}
+
+// job returns the payload fetching t, which tracks t once it is found.
+func (t target) job() job {
+	switch t.Type {
+	case "org":
+		return orgPayload{Login: t.Name, Track: true}
+	case "repo":
+		split := strings.SplitN(t.Name, "/", 2)
+		return repoPayload{Owner: split[0], Name: split[1], Track: true}
+	default:
+		return userPayload{Login: t.Name, Track: true}
+	}
+}
@@ -3,11 +3,20 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/go-github/github"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
@@ -17,80 +26,433 @@ func newStore(db *sqlx.DB) *store {
 
 type store struct{ db *sqlx.DB }
 
+// comment kinds
+const (
+	kindIssue  = "issue"  // github.IssueComment
+	kindReview = "review" // github.PullRequestComment
+	kindBody   = "body"   // github.Issue, ranked by the reactions to its body
+	kindCommit = "commit" // github.RepositoryComment
+	// githubTeamDiscussionComment, stored as a github.IssueComment of the org
+	kindDiscussion = "discussion"
+)
+
 type comment struct {
+	Kind    string
 	Comment github.IssueComment
 	Repo    string
+
+	// for review and commit comments, the diff the comment is about
+	Path, DiffHunk string
+	// for commit comments
+	CommitID string
+	// for issue bodies
+	Title string
+	// for team discussion comments, the slug of the team
+	Team string
+	// when searching, the fragments of the body that match
+	Snippet template.HTML
+
+	// the total counts of reactions of the snapshots, oldest first
+	Sparkline []int
+	// on trending comments, the reactions gained during the window
+	Gained int
 }
 
-func (s *store) getComments(ctx context.Context) ([]comment, error) {
-	var dest []struct {
-		J    []byte
-		Repo string
+// sparks are the bars of Spark, from the lowest to the highest.
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// maxSparks is the number of snapshots drawn by Spark, the last ones.
+const maxSparks = 20
+
+// Spark draws the sparkline of c with bars.
+func (c comment) Spark() string {
+	points := c.Sparkline
+	if len(points) > maxSparks {
+		points = points[len(points)-maxSparks:]
 	}
-	if err := s.db.SelectContext(ctx, &dest,
-		`select j, repo from comments
-		where (j#>>'{reactions,total_count}')::int > 0
-		order by (j#>>'{reactions,total_count}')::int desc limit 100`,
-	); err != nil {
-		return nil, errors.WithStack(err)
+	if len(points) < 2 {
+		return ""
 	}
-
-	comments := make([]comment, len(dest))
-	for i := range dest {
-		if err := json.Unmarshal(dest[i].J, &comments[i].Comment); err != nil {
-			return nil, errors.WithStack(err)
+	min, max := points[0], points[0]
+	for _, v := range points {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
 		}
-		comments[i].Repo = dest[i].Repo
 	}
-	return comments, nil
+	spark := make([]rune, len(points))
+	for i, v := range points {
+		spark[i] = sparks[0]
+		if max > min {
+			spark[i] = sparks[(v-min)*(len(sparks)-1)/(max-min)]
+		}
+	}
+	return string(spark)
 }
 
-func (s *store) getCommentsForUser(ctx context.Context, user string) ([]comment, error) {
-	var dest []struct {
-		J    []byte
-		Repo string
+type commentRow struct {
+	J        []byte
+	Repo     string
+	Kind     string
+	Headline string
+	Gained   int
+
+	Rank int64 // the value of the sort expression
+	ID   int64
+}
+
+func (r commentRow) cursor() *cursor { return &cursor{Rank: r.Rank, ID: r.ID, Kind: r.Kind} }
+
+// cursor is the position of a comment in a ranking, to list the comments
+// after or before it. Comments are ranked by their reactions, then by id and
+// kind to break ties.
+type cursor struct {
+	Rank int64
+	ID   int64
+	Kind string
+}
+
+func (c *cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%s", c.Rank, c.ID, c.Kind)))
+}
+
+func parseCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid cursor %q", s)
 	}
-	if err := s.db.SelectContext(ctx, &dest,
-		`select j, repo from comments
-		where (j#>>'{reactions,total_count}')::int > 0 and j#>>'{user,login}' = $1
-		order by (j#>>'{reactions,total_count}')::int desc limit 100`,
-		user,
-	); err != nil {
-		return nil, errors.WithStack(err)
+	split := strings.SplitN(string(b), ":", 3)
+	if len(split) != 3 {
+		return nil, errors.Errorf("invalid cursor %q", s)
+	}
+	var c cursor
+	if c.Rank, err = strconv.ParseInt(split[0], 10, 64); err != nil {
+		return nil, errors.Wrapf(err, "invalid cursor %q", s)
+	}
+	if c.ID, err = strconv.ParseInt(split[1], 10, 64); err != nil {
+		return nil, errors.Wrapf(err, "invalid cursor %q", s)
 	}
+	c.Kind = split[2]
+	return &c, nil
+}
+
+var discussionURLRegexp = regexp.MustCompile(`^https://github\.com/orgs/[\w-]+/teams/([\w-]+)/discussions/`)
 
-	comments := make([]comment, len(dest))
-	for i := range dest {
-		if err := json.Unmarshal(dest[i].J, &comments[i].Comment); err != nil {
+func decodeComments(rows []commentRow) ([]comment, error) {
+	comments := make([]comment, len(rows))
+	for i := range rows {
+		if err := json.Unmarshal(rows[i].J, &comments[i].Comment); err != nil {
 			return nil, errors.WithStack(err)
 		}
-		comments[i].Repo = dest[i].Repo
+		comments[i].Repo = rows[i].Repo
+		comments[i].Kind = rows[i].Kind
+		comments[i].Snippet = highlight(rows[i].Headline)
+		comments[i].Gained = rows[i].Gained
+		if rows[i].Kind == kindReview {
+			var review github.PullRequestComment
+			if err := json.Unmarshal(rows[i].J, &review); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			comments[i].Path = review.GetPath()
+			comments[i].DiffHunk = review.GetDiffHunk()
+		}
+		if rows[i].Kind == kindCommit {
+			var commit github.RepositoryComment
+			if err := json.Unmarshal(rows[i].J, &commit); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			comments[i].Path = commit.GetPath()
+			comments[i].CommitID = commit.GetCommitID()
+		}
+		if rows[i].Kind == kindDiscussion {
+			if m := discussionURLRegexp.FindStringSubmatch(comments[i].Comment.GetHTMLURL()); m != nil {
+				comments[i].Team = m[1]
+			}
+		}
+		if rows[i].Kind == kindBody {
+			var issue github.Issue
+			if err := json.Unmarshal(rows[i].J, &issue); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			comments[i].Title = issue.GetTitle()
+		}
 	}
 	return comments, nil
 }
 
-func (s *store) getCommentsForRepo(ctx context.Context, owner, repo string) ([]comment, error) {
-	var dest []struct {
-		J    []byte
-		Repo string
+// commentFilter selects the comments to rank. Empty fields don't filter.
+type commentFilter struct {
+	User string
+	Org  string // owner of the repo
+	Repo string // owner/name
+	Show string // "comments" or "issues", for issue and pull request bodies
+	Sort string // one of sorts, total by default
+
+	Search       string // words the body must match
+	MinReactions int
+
+	// select the comments created in the last Window, one of windows, or
+	// between From and To, both inclusive dates
+	Window   string
+	From, To time.Time
+
+	// at most one of them is set, to list the comments after or before
+	// a cursor
+	After, Before *cursor
+}
+
+// sorts holds the expressions the comments can be ranked by. They have
+// matching indexes in migrations.
+var sorts = map[string]string{
+	"total":     `(j#>>'{reactions,total_count}')::int`,
+	"plus_one":  `(j#>>'{reactions,+1}')::int`,
+	"minus_one": `(j#>>'{reactions,-1}')::int`,
+	"laugh":     `(j#>>'{reactions,laugh}')::int`,
+	"confused":  `(j#>>'{reactions,confused}')::int`,
+	"heart":     `(j#>>'{reactions,heart}')::int`,
+	"hooray":    `(j#>>'{reactions,hooray}')::int`,
+	"score":     `(coalesce((j#>>'{reactions,+1}')::int, 0) - coalesce((j#>>'{reactions,-1}')::int, 0))`,
+}
+
+// windows holds the time windows of recent comments.
+var windows = map[string]time.Duration{
+	"24h":  24 * time.Hour,
+	"7d":   7 * 24 * time.Hour,
+	"30d":  30 * 24 * time.Hour,
+	"365d": 365 * 24 * time.Hour,
+}
+
+// dateLayout is the layout of the from and to query parameters.
+const dateLayout = "2006-01-02"
+
+// Query returns the query string of the view of filter, with key set to
+// value, starting with ?.
+func (f commentFilter) Query(key, value string) string {
+	q := make(url.Values)
+	if f.Show != "" {
+		q.Set("show", f.Show)
+	}
+	if f.Sort != "" {
+		q.Set("sort", f.Sort)
 	}
+	if f.Search != "" {
+		q.Set("q", f.Search)
+	}
+	if f.MinReactions > 0 {
+		q.Set("min_reactions", strconv.Itoa(f.MinReactions))
+	}
+	if f.Window != "" {
+		q.Set("window", f.Window)
+	}
+	if !f.From.IsZero() {
+		q.Set("from", f.From.Format(dateLayout))
+	}
+	if !f.To.IsZero() {
+		q.Set("to", f.To.Format(dateLayout))
+	}
+	if value == "" {
+		q.Del(key)
+	} else {
+		q.Set(key, value)
+	}
+	return "?" + q.Encode()
+}
+
+// commentsSQL selects the comments and issue bodies to rank, with the same
+// columns.
+const commentsSQL = `select j, repo, kind, deleted_at from comments
+union all
+` + issuesSQL
+
+const issuesSQL = `select j, regexp_replace(j->>'repository_url', '^.*/repos/', '') as repo, 'body' as kind, deleted_at from issues`
+
+// searchVector is the text search vector of the bodies, which has a
+// matching index in migrations.
+const searchVector = `to_tsvector('english', coalesce(j->>'body', ''))`
+
+// headlineOptions delimit the matches in headlines with characters of the
+// private use area, that highlight replaces with marks.
+const headlineOptions = "StartSel=\ue000, StopSel=\ue001, MaxFragments=3, MaxWords=30, MinWords=10"
+
+// commentsPerPage is the number of comments returned by getComments.
+const commentsPerPage = 100
+
+// commentPage is a page of comments. Next and Prev are nil on the last and
+// first pages.
+type commentPage struct {
+	Comments   []comment
+	Next, Prev *cursor
+}
+
+func (s *store) getComments(ctx context.Context, filter commentFilter) (*commentPage, error) {
+	from := "(" + commentsSQL + ") items"
+	switch filter.Show {
+	case "comments":
+		from = "comments"
+	case "issues":
+		from = "(" + issuesSQL + ") items"
+	}
+
+	order, ok := sorts[filter.Sort]
+	if !ok {
+		order = sorts["total"]
+	}
+	var (
+		// deleted comments are kept, but not ranked
+		where = []string{sorts["total"] + ` > 0`, `deleted_at is null`}
+		args  []interface{}
+	)
+	if filter.Sort != "score" && order != sorts["total"] {
+		// only rank the comments that got the reaction
+		where = append(where, order+` > 0`)
+	}
+	if filter.User != "" {
+		args = append(args, filter.User)
+		where = append(where, fmt.Sprintf(`j#>>'{user,login}' = $%d`, len(args)))
+	}
+	if filter.Org != "" {
+		args = append(args, filter.Org)
+		where = append(where, fmt.Sprintf(`split_part(repo, '/', 1) = $%d`, len(args)))
+	}
+	if filter.Repo != "" {
+		args = append(args, filter.Repo)
+		where = append(where, fmt.Sprintf(`repo = $%d`, len(args)))
+	}
+	if filter.MinReactions > 0 {
+		args = append(args, filter.MinReactions)
+		where = append(where, fmt.Sprintf(sorts["total"]+` >= $%d`, len(args)))
+	}
+	if d, ok := windows[filter.Window]; ok {
+		args = append(args, time.Now().Add(-d))
+		where = append(where, fmt.Sprintf(`jsonb_created_at(j) >= $%d`, len(args)))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		where = append(where, fmt.Sprintf(`jsonb_created_at(j) >= $%d`, len(args)))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To.AddDate(0, 0, 1))
+		where = append(where, fmt.Sprintf(`jsonb_created_at(j) < $%d`, len(args)))
+	}
+	headline := `''`
+	if filter.Search != "" {
+		args = append(args, filter.Search)
+		where = append(where, fmt.Sprintf(searchVector+` @@ plainto_tsquery('english', $%d)`, len(args)))
+		args = append(args, headlineOptions)
+		headline = fmt.Sprintf(`ts_headline('english', coalesce(j->>'body', ''), plainto_tsquery('english', $%d), $%d)`, len(args)-1, len(args))
+	}
+
+	direction := "desc"
+	if c := filter.After; c != nil {
+		args = append(args, c.Rank, c.ID, c.Kind)
+		where = append(where, fmt.Sprintf(`(%s, (j->>'id')::bigint, kind) < ($%d, $%d, $%d)`, order, len(args)-2, len(args)-1, len(args)))
+	} else if c := filter.Before; c != nil {
+		// list the previous comments from the closest one, then reverse them
+		args = append(args, c.Rank, c.ID, c.Kind)
+		where = append(where, fmt.Sprintf(`(%s, (j->>'id')::bigint, kind) > ($%d, $%d, $%d)`, order, len(args)-2, len(args)-1, len(args)))
+		direction = "asc"
+	}
+
+	var dest []commentRow
 	if err := s.db.SelectContext(ctx, &dest,
-		`select j, repo from comments
-		where (j#>>'{reactions,total_count}')::int > 0 and repo = $1
-		order by (j#>>'{reactions,total_count}')::int desc limit 100`,
-		strings.Join([]string{owner, repo}, "/"),
+		// headlines are only computed for the comments of the page
+		`select j, repo, kind, rank, id, `+headline+` as headline from (
+			select j, repo, kind, `+order+` as rank, (j->>'id')::bigint as id from `+from+`
+			where `+strings.Join(where, " and ")+`
+			order by rank `+direction+`, id `+direction+`, kind `+direction+`
+			limit `+strconv.Itoa(commentsPerPage+1)+`
+		) ranked
+		order by rank `+direction+`, id `+direction+`, kind `+direction,
+		args...,
 	); err != nil {
 		return nil, errors.WithStack(err)
 	}
+	more := len(dest) > commentsPerPage
+	if more {
+		dest = dest[:commentsPerPage]
+	}
+	if filter.Before != nil {
+		for i, j := 0, len(dest)-1; i < j; i, j = i+1, j-1 {
+			dest[i], dest[j] = dest[j], dest[i]
+		}
+	}
 
-	comments := make([]comment, len(dest))
-	for i := range dest {
-		if err := json.Unmarshal(dest[i].J, &comments[i].Comment); err != nil {
-			return nil, errors.WithStack(err)
+	page := new(commentPage)
+	if len(dest) > 0 {
+		if filter.After != nil || (filter.Before != nil && more) {
+			page.Prev = dest[0].cursor()
+		}
+		if filter.Before != nil || more {
+			page.Next = dest[len(dest)-1].cursor()
 		}
-		comments[i].Repo = dest[i].Repo
 	}
-	return comments, nil
+	var err error
+	page.Comments, err = decodeComments(dest)
+	return page, err
+}
+
+// getTrending returns the comments that gained the most reactions since
+// since. The gain is counted from the last snapshot before since, or from the
+// first one for the comments fetched after since.
+func (s *store) getTrending(ctx context.Context, since time.Time) ([]comment, error) {
+	var dest []commentRow
+	if err := s.db.SelectContext(ctx, &dest, `select items.j, items.repo, items.kind, trending.gained
+	from (
+		select latest.kind, latest.id, latest.total_count - base.total_count as gained
+		from (
+			select distinct on (kind, id) kind, id, total_count from reaction_snapshots
+			where taken_at > $1
+			order by kind, id, taken_at desc
+		) latest
+		join lateral (
+			select total_count from reaction_snapshots s
+			where s.kind = latest.kind and s.id = latest.id
+			order by taken_at <= $1 desc, case when taken_at <= $1 then taken_at end desc, taken_at
+			limit 1
+		) base on true
+		where latest.total_count > base.total_count
+		order by gained desc
+		limit $2
+	) trending
+	join (`+commentsSQL+`) items on items.kind = trending.kind and (items.j->>'id')::bigint = trending.id
+	where items.deleted_at is null
+	order by trending.gained desc`, since, commentsPerPage); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return decodeComments(dest)
+}
+
+// loadSparklines sets the sparklines of comments from their snapshots.
+func (s *store) loadSparklines(ctx context.Context, comments []comment) error {
+	if len(comments) == 0 {
+		return nil
+	}
+	var (
+		kinds = make([]string, len(comments))
+		ids   = make([]int64, len(comments))
+		index = make(map[string]int)
+	)
+	for i, c := range comments {
+		kinds[i], ids[i] = c.Kind, c.Comment.GetID()
+		index[fmt.Sprintf("%s:%d", c.Kind, c.Comment.GetID())] = i
+	}
+	var dest []struct {
+		Kind       string
+		ID         int64
+		TotalCount int `db:"total_count"`
+	}
+	if err := s.db.SelectContext(ctx, &dest, `select kind, id, total_count from reaction_snapshots
+	where (kind, id) in (select unnest($1::text[]), unnest($2::bigint[]))
+	order by taken_at`, pq.Array(kinds), pq.Array(ids)); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, d := range dest {
+		i := index[fmt.Sprintf("%s:%d", d.Kind, d.ID)]
+		comments[i].Sparkline = append(comments[i].Sparkline, d.TotalCount)
+	}
+	return nil
 }
 
 func (s *store) issueIsUpToDate(ctx context.Context, issue *github.Issue) (bool, error) {
@@ -113,7 +475,7 @@ func (s *store) issueIsUpToDate(ctx context.Context, issue *github.Issue) (bool,
 func (s *store) countCommentsForIssue(ctx context.Context, issue *github.Issue) (int, error) {
 	var count int
 	err := s.db.GetContext(ctx, &count,
-		`select count(*) from comments where j->>'issue_url' = $1`,
+		`select count(*) from comments where kind = 'issue' and j->>'issue_url' = $1 and deleted_at is null`,
 		issue.GetURL(),
 	)
 	return count, errors.WithStack(err)
@@ -121,7 +483,7 @@ func (s *store) countCommentsForIssue(ctx context.Context, issue *github.Issue)
 
 func (s *store) getIssue(ctx context.Context, id int64) (*github.Issue, error) {
 	var dest []byte
-	if err := s.db.GetContext(ctx, &dest, `select j from issues where (j->>'id')::int = $1`, id); err == sql.ErrNoRows {
+	if err := s.db.GetContext(ctx, &dest, `select j from issues where (j->>'id')::bigint = $1`, id); err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, errors.WithStack(err)
@@ -136,11 +498,64 @@ func (s *store) insertComment(ctx context.Context, comment *github.IssueComment,
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	_, err = s.db.ExecContext(ctx, `insert into comments values($1, $2)
-	on conflict (((j->>'id')::int)) do update
-	set j = excluded.j
-	where (comments.j->>'updated_at')::timestamp < (excluded.j->>'updated_at')::timestamp`, j, repo)
-	return errors.Wrapf(err, "couldn't insert comment %s", comment.GetURL())
+	return errors.Wrapf(s.upsertComment(ctx, j, repo, kindIssue),
+		"couldn't insert comment %s", comment.GetURL())
+}
+
+func (s *store) insertReviewComment(ctx context.Context, comment *github.PullRequestComment, repo string) error {
+	j, err := json.Marshal(comment)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(s.upsertComment(ctx, j, repo, kindReview),
+		"couldn't insert review comment %s", comment.GetURL())
+}
+
+func (s *store) insertCommitComment(ctx context.Context, comment *github.RepositoryComment, repo string) error {
+	j, err := json.Marshal(comment)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(s.upsertComment(ctx, j, repo, kindCommit),
+		"couldn't insert commit comment %s", comment.GetURL())
+}
+
+func (s *store) insertDiscussionComment(ctx context.Context, comment *github.IssueComment, org string) error {
+	j, err := json.Marshal(comment)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(s.upsertComment(ctx, j, org, kindDiscussion),
+		"couldn't insert team discussion comment %s", comment.GetURL())
+}
+
+// upsertComment inserts or updates the comment j, and marks it as seen.
+// Reactions don't change updated_at, so comments are updated when it is the
+// same too.
+func (s *store) upsertComment(ctx context.Context, j []byte, repo, kind string) error {
+	if _, err := s.db.ExecContext(ctx, `insert into comments(j, repo, kind, seen_at) values($1, $2, $3, now())
+	on conflict (kind, ((j->>'id')::bigint)) do update
+	set j = case
+		when (comments.j->>'updated_at')::timestamp <= (excluded.j->>'updated_at')::timestamp then excluded.j
+		else comments.j
+	end, seen_at = excluded.seen_at, deleted_at = null`, j, repo, kind); err != nil {
+		return err
+	}
+	return s.snapshotReactions(ctx, kind, j)
+}
+
+// snapshotReactions appends the reactions of the comment j of kind to its
+// history, if they changed since the last snapshot.
+func (s *store) snapshotReactions(ctx context.Context, kind string, j []byte) error {
+	_, err := s.db.ExecContext(ctx, `insert into reaction_snapshots(kind, id, total_count, reactions)
+	select $1, (j->>'id')::bigint, (j#>>'{reactions,total_count}')::int, j->'reactions'
+	from (select $2::jsonb as j) new
+	where j ? 'reactions' and (
+		select reactions from reaction_snapshots
+		where kind = $1 and id = (new.j->>'id')::bigint
+		order by taken_at desc limit 1
+	) is distinct from j->'reactions'`, kind, j)
+	return errors.WithStack(err)
 }
 
 func (s *store) insertIssue(ctx context.Context, issue *github.Issue) error {
@@ -148,9 +563,247 @@ func (s *store) insertIssue(ctx context.Context, issue *github.Issue) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	_, err = s.db.ExecContext(ctx, `insert into issues values($1)
-	on conflict (((j->>'id')::int)) do update
-	set j = excluded.j
-	where (issues.j->>'updated_at')::timestamp < (excluded.j->>'updated_at')::timestamp`, j)
-	return errors.Wrapf(err, "couldn't insert issue %s", issue.GetURL())
+	if _, err = s.db.ExecContext(ctx, `insert into issues values($1)
+	on conflict (((j->>'id')::bigint)) do update
+	set j = case
+		when (issues.j->>'updated_at')::timestamp <= (excluded.j->>'updated_at')::timestamp then excluded.j
+		else issues.j
+	end, deleted_at = null`, j); err != nil {
+		return errors.Wrapf(err, "couldn't insert issue %s", issue.GetURL())
+	}
+	return errors.Wrapf(s.snapshotReactions(ctx, kindBody, j),
+		"couldn't snapshot reactions of issue %s", issue.GetURL())
+}
+
+// now returns the time of the database, that sets seen_at.
+func (s *store) now(ctx context.Context) (time.Time, error) {
+	var now time.Time
+	err := s.db.GetContext(ctx, &now, `select now()`)
+	return now, errors.WithStack(err)
+}
+
+// deleteUnseenComments marks the comments of kind whose parent, an issue or
+// a pull request, is url as deleted, when they were not seen since since.
+func (s *store) deleteUnseenComments(ctx context.Context, kind, url string, since time.Time) error {
+	parent := "issue_url"
+	if kind == kindReview {
+		parent = "pull_request_url"
+	}
+	_, err := s.db.ExecContext(ctx, `update comments set deleted_at = now()
+	where kind = $1 and j->>'`+parent+`' = $2 and seen_at < $3 and deleted_at is null`, kind, url, since)
+	return errors.Wrapf(err, "couldn't delete unseen comments of %s", url)
+}
+
+// deleteIssue marks the issue at the API URL url as deleted, with its
+// comments and the review comments of its pull request.
+func (s *store) deleteIssue(ctx context.Context, url string) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `update issues set deleted_at = now()
+	where j->>'url' = $1 and deleted_at is null`, url); err != nil {
+		return errors.Wrapf(err, "couldn't delete issue %s", url)
+	}
+	pullURL := strings.Replace(url, "/issues/", "/pulls/", 1)
+	if _, err := tx.ExecContext(ctx, `update comments set deleted_at = now()
+	where ((kind = $1 and j->>'issue_url' = $2) or (kind = $3 and j->>'pull_request_url' = $4))
+	and deleted_at is null`, kindIssue, url, kindReview, pullURL); err != nil {
+		return errors.Wrapf(err, "couldn't delete comments of issue %s", url)
+	}
+	return errors.WithStack(tx.Commit())
+}
+
+// deleteComment marks the comment of kind and id as deleted.
+func (s *store) deleteComment(ctx context.Context, kind string, id int64) error {
+	var err error
+	if kind == kindBody {
+		_, err = s.db.ExecContext(ctx, `update issues set deleted_at = now()
+		where (j->>'id')::bigint = $1 and deleted_at is null`, id)
+	} else {
+		_, err = s.db.ExecContext(ctx, `update comments set deleted_at = now()
+		where kind = $1 and (j->>'id')::bigint = $2 and deleted_at is null`, kind, id)
+	}
+	return errors.Wrapf(err, "couldn't delete %s %d", kind, id)
+}
+
+// getRepoSyncedAt returns the updated_at of the most recently updated issue of
+// repo when it was last completely synced, or the zero time.
+func (s *store) getRepoSyncedAt(ctx context.Context, repo string) (time.Time, error) {
+	var syncedAt time.Time
+	if err := s.db.GetContext(ctx, &syncedAt, `select synced_at from repos where repo = $1`, repo); err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	return syncedAt, nil
+}
+
+func (s *store) setRepoSyncedAt(ctx context.Context, repo string, syncedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `insert into repos values($1, $2)
+	on conflict (repo) do update
+	set synced_at = excluded.synced_at
+	where repos.synced_at < excluded.synced_at`, repo, syncedAt)
+	return errors.Wrapf(err, "couldn't set synced_at of repo %s", repo)
+}
+
+// ownerType returns the type of the GitHub account login, User or
+// Organization, or an empty string if it is not known yet.
+func (s *store) ownerType(ctx context.Context, login string) (string, error) {
+	var typ string
+	if err := s.db.GetContext(ctx, &typ, `select type from owners where login = lower($1)`, login); err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return typ, nil
+}
+
+func (s *store) setOwnerType(ctx context.Context, login, typ string) error {
+	_, err := s.db.ExecContext(ctx, `insert into owners values(lower($1), $2)
+	on conflict (login) do update set type = excluded.type`, login, typ)
+	return errors.Wrapf(err, "couldn't set type of %s", login)
+}
+
+// trackTarget inserts t in the tracked targets, or updates it. Its interval
+// is reset to interval when active, and doubles up to max otherwise. Its next
+// fetch is scheduled after its interval.
+func (s *store) trackTarget(ctx context.Context, t target, interval, max time.Duration, active bool) error {
+	const next = `case when $5 then excluded.interval_seconds
+		else least(tracked_targets.interval_seconds * 2, $4::bigint) end`
+	_, err := s.db.ExecContext(ctx, `insert into tracked_targets(type, name, interval_seconds, next_run_at, fetched_at)
+	values($1, $2, $3::bigint, now() + $3::bigint * interval '1 second', now())
+	on conflict (type, name) do update
+	set interval_seconds = `+next+`, next_run_at = now() + (`+next+`) * interval '1 second',
+	fetched_at = excluded.fetched_at`,
+		t.Type, t.Name, int64(interval/time.Second), int64(max/time.Second), active)
+	return errors.Wrapf(err, "couldn't track %s %s", t.Type, t.Name)
+}
+
+// targetFetchedAt returns when a fetch last tracked t, or the zero time.
+func (s *store) targetFetchedAt(ctx context.Context, t target) (time.Time, error) {
+	var fetchedAt pq.NullTime
+	err := s.db.GetContext(ctx, &fetchedAt, `select fetched_at from tracked_targets
+	where type = $1 and name = $2`, t.Type, t.Name)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return fetchedAt.Time, errors.Wrapf(err, "couldn't get fetched_at of %s %s", t.Type, t.Name)
+}
+
+// postponeTarget schedules the next fetch of t after its interval.
+func (s *store) postponeTarget(ctx context.Context, t target) error {
+	_, err := s.db.ExecContext(ctx, `update tracked_targets
+	set next_run_at = now() + interval_seconds * interval '1 second'
+	where type = $1 and name = $2`, t.Type, t.Name)
+	return errors.Wrapf(err, "couldn't postpone %s %s", t.Type, t.Name)
+}
+
+// visitTarget records a visit of t, if it is tracked.
+func (s *store) visitTarget(ctx context.Context, t target) error {
+	_, err := s.db.ExecContext(ctx, `update tracked_targets set visited_at = now()
+	where type = $1 and name = $2`, t.Type, t.Name)
+	return errors.Wrapf(err, "couldn't visit %s %s", t.Type, t.Name)
+}
+
+// expireTargets stops tracking the targets that were not visited since
+// before, and returns how many they were.
+func (s *store) expireTargets(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `delete from tracked_targets where visited_at < $1`, before)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	n, err := res.RowsAffected()
+	return n, errors.WithStack(err)
+}
+
+// dueTargets returns at most n targets of type typ to fetch, the most overdue
+// first.
+func (s *store) dueTargets(ctx context.Context, typ string, n int) ([]target, error) {
+	var targets []target
+	if err := s.db.SelectContext(ctx, &targets, `select type, name from tracked_targets
+	where type = $1 and next_run_at <= now()
+	order by next_run_at limit $2`, typ, n); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return targets, nil
+}
+
+// hotComments returns the payloads refreshing the reactions of at most n
+// comments and issues of the last 30 days, by decreasing reactions per hour
+// of age, that weren't refreshed in the last hour.
+func (s *store) hotComments(ctx context.Context, n int) ([]reactionsPayload, error) {
+	var dest []reactionsPayload
+	err := s.db.SelectContext(ctx, &dest, `select items.kind, items.repo, (items.j->>'id')::bigint as id, coalesce(items.j->>'url', '') as url
+	from (`+commentsSQL+`) items
+	left join reaction_refreshes r on r.kind = items.kind and r.id = (items.j->>'id')::bigint
+	where items.deleted_at is null and jsonb_created_at(items.j) > now() - interval '30 days'
+	and (r.refreshed_at is null or r.refreshed_at < now() - interval '1 hour')
+	order by (items.j#>>'{reactions,total_count}')::int / power(extract(epoch from now() - jsonb_created_at(items.j)) / 3600 + 2, 1.5) desc
+	limit $1`, n)
+	return dest, errors.WithStack(err)
+}
+
+func (s *store) setRefreshedAt(ctx context.Context, kind string, id int64) error {
+	_, err := s.db.ExecContext(ctx, `insert into reaction_refreshes values($1, $2, now())
+	on conflict (kind, id) do update
+	set refreshed_at = excluded.refreshed_at`, kind, id)
+	return errors.Wrapf(err, "couldn't set refreshed_at of %s %d", kind, id)
+}
+
+type cachedResponse struct {
+	ETag, LastModified string
+	Header             http.Header
+	Body               []byte
+}
+
+func (s *store) getCachedResponse(ctx context.Context, key string) (*cachedResponse, error) {
+	var dest struct {
+		ETag         string `db:"etag"`
+		LastModified string `db:"last_modified"`
+		Header       []byte
+		Body         []byte
+	}
+	if err := s.db.GetContext(ctx, &dest,
+		`select etag, last_modified, header, body from http_cache where key = $1`, key,
+	); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r := &cachedResponse{ETag: dest.ETag, LastModified: dest.LastModified, Body: dest.Body}
+	err := json.Unmarshal(dest.Header, &r.Header)
+	return r, errors.WithStack(err)
+}
+
+func (s *store) putCachedResponse(ctx context.Context, key string, r *cachedResponse) error {
+	header, err := json.Marshal(r.Header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = s.db.ExecContext(ctx, `insert into http_cache(key, etag, last_modified, header, body) values($1, $2, $3, $4, $5)
+	on conflict (key) do update
+	set etag = excluded.etag, last_modified = excluded.last_modified, header = excluded.header, body = excluded.body, used_at = now()`,
+		key, r.ETag, r.LastModified, header, r.Body)
+	return errors.Wrapf(err, "couldn't cache response for %s", key)
+}
+
+// touchCachedResponse records that the response cached for key was
+// revalidated.
+func (s *store) touchCachedResponse(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `update http_cache set used_at = now() where key = $1`, key)
+	return errors.Wrapf(err, "couldn't touch cached response for %s", key)
+}
+
+// pruneCachedResponses deletes the responses that were not used since
+// before, and returns how many were deleted.
+func (s *store) pruneCachedResponses(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `delete from http_cache where used_at < $1`, before)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	n, err := res.RowsAffected()
+	return n, errors.WithStack(err)
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cachingTransport makes conditional requests with the ETag or Last-Modified
+// of the last response it stored for the same URL. GitHub doesn't count 304
+// Not Modified responses against the rate limit; they are replaced with the
+// stored response, with the X-From-Cache header set.
+type cachingTransport struct {
+	store     *store
+	transport http.RoundTripper
+}
+
+func newCachingTransport(store *store, transport http.RoundTripper) *cachingTransport {
+	return &cachingTransport{store: store, transport: transport}
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.transport.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	// responses vary with the preview media types
+	key := req.URL.String() + " " + req.Header.Get("Accept")
+	cached, err := t.store.getCachedResponse(ctx, key)
+	if err != nil {
+		log.Printf("%+v", err)
+	}
+	if cached != nil {
+		// a RoundTripper must not modify the request
+		req = req.WithContext(ctx)
+		req.Header = cloneHeader(req.Header)
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		if err := t.store.touchCachedResponse(ctx, key); err != nil {
+			log.Printf("%+v", err)
+		}
+		header := cloneHeader(cached.Header)
+		// keep the rate limit of the conditional request
+		for k, v := range resp.Header {
+			if strings.HasPrefix(k, "X-Ratelimit-") {
+				header[k] = v
+			}
+		}
+		header.Set("X-From-Cache", "1")
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(cached.Body)),
+			ContentLength: int64(len(cached.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err := t.store.putCachedResponse(ctx, key, &cachedResponse{
+		ETag:         etag,
+		LastModified: lastModified,
+		Header:       resp.Header,
+		Body:         body,
+	}); err != nil {
+		log.Printf("%+v", err)
+	}
+	return resp, nil
+}
+
+const pruneInterval = time.Hour
+
+// Prune deletes the stored responses that were not used for ttl, every
+// pruneInterval until ctx is canceled. Most URLs are never requested again,
+// like the ones listing the issues updated since the last sync.
+func (t *cachingTransport) Prune(ctx context.Context, ttl time.Duration) error {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		n, err := t.store.pruneCachedResponses(ctx, time.Now().Add(-ttl))
+		if err != nil {
+			log.Printf("%+v", err)
+		} else if n > 0 {
+			log.Printf("pruned %d cached responses", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
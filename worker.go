@@ -1,9 +1,18 @@
 package main
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 func worker(ctx context.Context, receiver *receiver, queue string, f handler) func() error {
 	return func() error {
 		return receiver.Consume(ctx, queue, f)
 	}
 }
+
+func sweeper(ctx context.Context, receiver *receiver, queue string, timeout time.Duration) func() error {
+	return func() error {
+		return receiver.Sweep(ctx, queue, timeout)
+	}
+}